@@ -0,0 +1,52 @@
+package gochat
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Splits input into at most n whitespace separated arguments, where the last argument is the
+// rest of the input with its spacing kept, such as a message's contents. n <= 0 splits all of
+// the input. An argument can be wrapped in double quotes to include spaces, e.g. "My Team",
+// and a quote or backslash inside one can be escaped with a backslash
+func SplitArgs(input string, n int) (args []string) {
+	rest := strings.TrimSpace(input)
+	for rest != "" && (n <= 0 || len(args) < n-1) {
+		var arg string
+		arg, rest = nextArg(rest)
+		args = append(args, arg)
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+	}
+	if rest != "" {
+		// Only unquote the rest of the input if it's a single quoted argument
+		if arg, after := nextArg(rest); rest[0] == '"' && after == "" {
+			rest = arg
+		}
+		args = append(args, rest)
+	}
+	return
+}
+
+// Returns the first argument of the input and what comes after it. A quoted argument ends at
+// its closing quote, or the end of the input if it isn't closed
+func nextArg(input string) (arg, rest string) {
+	if input[0] != '"' {
+		if end := strings.IndexFunc(input, unicode.IsSpace); end >= 0 {
+			return input[:end], input[end:]
+		}
+		return input, ""
+	}
+	var builder strings.Builder
+	for i := 1; i < len(input); i++ {
+		switch c := input[i]; {
+		case c == '\\' && i+1 < len(input) && (input[i+1] == '"' || input[i+1] == '\\'):
+			i++
+			builder.WriteByte(input[i])
+		case c == '"':
+			return builder.String(), input[i+1:]
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String(), ""
+}
@@ -0,0 +1,37 @@
+package gochat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		input string
+		n int
+		want []string
+	}{
+		{"", 0, nil},
+		{"   ", 0, nil},
+		{"create team", 0, []string{"create", "team"}},
+		{"  a   b  ", 0, []string{"a", "b"}},
+		{"a\tb\nc", 0, []string{"a", "b", "c"}},
+		{`"My Team" hello`, 0, []string{"My Team", "hello"}},
+		{`say "" now`, 0, []string{"say", "", "now"}},
+		{`"say \"hi\" \\ now"`, 0, []string{`say "hi" \ now`}},
+		{`"a \n b"`, 0, []string{`a \n b`}},
+		{`"unclosed arg`, 0, []string{"unclosed arg"}},
+		{"a b c", 1, []string{"a b c"}},
+		{"team hello   there", 2, []string{"team", "hello   there"}},
+		{`team "quoted rest"`, 2, []string{"team", "quoted rest"}},
+		{`team "a" b`, 2, []string{"team", `"a" b`}},
+		{`"My Team" hi there`, 2, []string{"My Team", "hi there"}},
+		{"a b", 5, []string{"a", "b"}},
+		{"a b c d", 3, []string{"a", "b", "c d"}},
+	}
+	for _, test := range tests {
+		if got := SplitArgs(test.input, test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SplitArgs(%q, %d) = %q, want %q", test.input, test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package clnt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"github.com/zembrodt/gochat"
+	"github.com/zembrodt/gochat/strset"
+)
+
+// A group in the Client's cache as it's saved by ExportGroups
+type cachedGroup struct {
+	Name string `json:"name"`
+	Owner string `json:"owner,omitempty"`
+	Users []string `json:"users"`
+	Mods []string `json:"mods,omitempty"`
+}
+
+// Writes the Client's cached groups and their members to the file at path as JSON, so they
+// can be restored with ImportGroups
+func (client *Client) ExportGroups(path string) error {
+	groups := []cachedGroup{}
+	for _, groupName := range client.MyGroups.GroupNames() {
+		if group, ok := client.MyGroups.Get(groupName); ok {
+			groups = append(groups, cachedGroup{groupName, group.Owner, group.Users.Array(), group.Mods.Array()})
+		}
+	}
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Adds the groups saved by ExportGroups in the file at path to the Client's cache. Nothing is
+// added unless the whole file can be read
+func (client *Client) ImportGroups(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("File %s doesn't exist.", path))
+	} else if err != nil {
+		return err
+	}
+	groups := []cachedGroup{}
+	if err = json.Unmarshal(data, &groups); err != nil {
+		return errors.New(fmt.Sprintf("File %s isn't a valid groups export: %s", path, err))
+	}
+	for _, group := range groups {
+		if group.Name == "" {
+			return errors.New(fmt.Sprintf("File %s has a group without a name.", path))
+		}
+	}
+	for _, group := range groups {
+		client.MyGroups.Create(group.Name, group.Owner)
+		for _, user := range group.Users {
+			client.MyGroups.AddUser(group.Name, user)
+		}
+		for _, mod := range group.Mods {
+			client.MyGroups.AddModerator(group.Name, mod)
+		}
+	}
+	return nil
+}
+
+// Compares the cached members of the group in a 'diff' response to the members the server has,
+// and sets the message to print listing where our cache is stale
+// NOTE: The server's members will be in response.Msg, separated by spaces
+func (client *Client) diffGroup(response *gochat.Msg) {
+	actual := strset.NewStringSetFromSlice(strings.Fields(response.Msg))
+	cached := strset.NewStringSet()
+	if group, ok := client.MyGroups.Get(response.To); ok {
+		cached.AddAll(group.Users.Array())
+	}
+	missing := actual.Difference(cached).SortedArray()
+	stale := cached.Difference(actual).SortedArray()
+	if len(missing) == 0 && len(stale) == 0 {
+		response.Msg = fmt.Sprintf("Cached members of %s match the server.", response.To)
+		return
+	}
+	response.Msg = fmt.Sprintf("Cached members of %s differ from the server:", response.To)
+	for _, user := range missing {
+		response.Msg += fmt.Sprintf("\n + %s", user)
+	}
+	for _, user := range stale {
+		response.Msg += fmt.Sprintf("\n - %s", user)
+	}
+}
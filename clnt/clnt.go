@@ -8,76 +8,225 @@ access without needing to ping the server.
 package clnt
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/zembrodt/gochat"
 	"net"
 	"encoding/gob"
 	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Client struct {
 	Username, Address string
+	DisplayName string // name other users are shown in messages, Username if empty
+	Server string // address of the server the Client is connected to
+	Transport gochat.Transport // used to send messages to the server and receive its responses
 	MyGroups *gochat.GroupMap // cached version of Client's groups
+	History []string // the most recent commands entered, oldest first, up to maxHistory
+	Token string // session token from the server, presented to reclaim our name on reconnecting
+	Downloads string // directory files sent to our groups are saved in
+	AutoRejoin bool // whether Connect rejoins our cached groups if the server started a new session
+	ShowIDs bool // whether group messages are printed with their IDs, so they can be replied to
+	seen *recentIDs // IDs of the messages most recently received, to skip duplicates
+	keys *keyring // our key pair and other users' public keys, generated on first use
+	keysOnce sync.Once
+	keysErr error
+	listener gochat.MsgListener // what Listen is receiving messages on, nil when not connected
+	connectedAt time.Time // when Connect last succeeded, guarded by listenerLock
+	listenerLock sync.Mutex
 }
 
-// Client constructor
-func NewClient(username string) *Client {
-	return &Client{username, "localhost", gochat.NewGroupMap()}
+// How many commands are kept in a Client's History
+const maxHistory = 100
+
+// A command the Client handles itself rather than sending to the server, as listed by 'help'
+type localCommand struct {
+	Usage string // the command and its arguments
+	Description string
+}
+
+// The commands the Client handles itself, in the order 'help' lists them
+var localCommands = []localCommand{
+	{"groups", "Lists the groups you're in."},
+	{"users <group>", "Lists the users in the group."},
+	{"everyone", "Lists the users in the global group, who are everyone online."},
+	{"file <group> <path>", "Sends the file at path to the group."},
+	{"export <path>", "Saves your cached groups to the file at path."},
+	{"import <path>", "Restores cached groups from the file at path."},
+	{"whoami", "Shows who you're connected as."},
+	{"status", "Shows whether you're connected and to where."},
+	{"uptime", "Shows how long you've been connected."},
+	{"history [n]", "Shows the last n commands you entered."},
+	{"reset", "Clears your cached groups and resyncs them with the server."},
 }
 
-// Connects a Client to a server and sends the 'init' message and starts a Client.Listen
-// goroutine on the port the server responds with
+// How many message IDs a Client remembers to skip duplicates of
+const maxRecentIDs = 256
+
+// Bounded set of message IDs, forgetting the oldest ID once it is full
+type recentIDs struct {
+	ids []string // ring buffer of IDs in the order they were added
+	next int // index in ids the next ID is added at
+	set map[string]bool
+	texts map[string]shownMsg // what each message said, if it was recorded with SetText
+	lock sync.Mutex
+}
+
+// A message as it was shown, remembered so replies to it can show it too
+type shownMsg struct {
+	group, text string
+}
+
+// Client constructor. A nil transport uses a gochat.TCPTransport
+func NewClient(username string, transport gochat.Transport) *Client {
+	if transport == nil {
+		transport = &gochat.TCPTransport{}
+	}
+	return &Client{
+		Username: username,
+		Address: "localhost",
+		Downloads: "downloads",
+		Transport: transport,
+		MyGroups: gochat.NewGroupMap(),
+		seen: newRecentIDs(maxRecentIDs),
+	}
+}
+
+// Connects a Client to a server, reporting the port it's listening on with
+// Client.ListenAndReportPort, and starts a Client.Listen goroutine on that port
 func (client *Client) Connect(address string) (err error) {
-	// Establish connection with the server
-    conn, err := net.Dial("tcp", address)
-	defer conn.Close()
+	previousToken := client.Token
+	listener, port, err := client.ListenAndReportPort(address)
+	if err != nil {
+		return
+	}
+	// Remember the server so requests are sent where we're registered
+	client.Server = address
+	client.listenerLock.Lock()
+	client.listener = listener
+	client.connectedAt = time.Now()
+	client.listenerLock.Unlock()
+	// Start the Listen goroutine
+	fmt.Println("Listening on port", port)
+	go client.Listen(listener)
+	//Add the global group to cache of client's groups
+	client.MyGroups.Create("global", "")
+	client.MyGroups.AddUser("global", client.Username)
+	// The server only keeps us in our groups if it resumed our session, which gives back the
+	// same token. Otherwise we're new to it, so join our cached groups again
+	if client.AutoRejoin && (previousToken == "" || client.Token != previousToken) {
+		client.rejoinGroups()
+	}
+	
+	return nil
+}
+
+// Clears the Client's cached groups, other than global, and asks the server to send the groups
+// we're in and their members so the cache is rebuilt
+func (client *Client) ResetCache() {
+	client.MyGroups.Clear()
+	client.MyGroups.Create("global", "")
+	client.MyGroups.AddUser("global", client.Username)
+	request := &gochat.Msg{User: client.Username, Cmd: "sync"}
+	if err := client.send(request); err != nil {
+		fmt.Println("Error sending msg:", err)
+	}
+}
+
+// Sends a 'join' for each of the Client's cached groups other than global, which every user is
+// put in when they connect
+func (client *Client) rejoinGroups() {
+	for _, groupName := range client.MyGroups.GroupNames() {
+		if groupName == "global" {
+			continue
+		}
+		request := &gochat.Msg{User: client.Username, To: groupName, Cmd: "join"}
+		if err := client.send(request); err != nil {
+			fmt.Println("Error rejoining group:", err)
+		}
+	}
+}
+
+// Binds the Client's Transport to an ephemeral port and sends the 'init' message reporting that
+// port to the server at the given address. Returns the bound listener and its port once the
+// server has confirmed it recorded the same port for the Client
+func (client *Client) ListenAndReportPort(address string) (listener gochat.MsgListener, port string, err error) {
+	// Let the OS pick the port so we only ever report one we're actually bound to
+	listener, err = client.Transport.Listen(fmt.Sprintf("%s:0", client.Address))
+	if err != nil {
+		return
+	}
+	// Release the listener if the server doesn't accept us
+	defer func() {
+		if err != nil {
+			listener.Close()
+		}
+	}()
+	_, port, err = net.SplitHostPort(listener.Addr())
+	if err != nil {
+		return
+	}
+	// Establish connection with the server. The handshake needs a reply on the same
+	// connection, so it's dialed directly rather than sent through the Transport
+    conn, err := client.dialer().Dial("tcp", address)
     if err != nil {
         return
     }
+	defer conn.Close()
 	encoder := gob.NewEncoder(conn)
     // Send the cmd 'init' to let the server know this is our first time connecting
-	request := &gochat.Msg{User: client.Username, Cmd: "init"}
+	request := &gochat.Msg{User: client.Username, To: client.DisplayName, Msg: port, Cmd: "init", Token: client.Token}
     err = encoder.Encode(request)
     if err != nil {
         fmt.Println("Encoder error:", err)
 		return
     }
-	// Get response from server for the port
-	var port string
-    decoder := gob.NewDecoder(conn)
-    err = decoder.Decode(&port)
+	// Get response from server confirming the port
+	response := &gochat.Msg{}
+    err = response.Retrieve(conn)
     if err != nil {
         fmt.Println("Decoding error:",err)
 		return
     }
-	// Check for special case that this username already exists on the server
-	if (port == "alreadyExists") {
-		return errors.New(fmt.Sprintf("Error: User '%s' already exists on the server!\n", client.Username))
-	}
-	// Start the Listen goroutine
-	errCh := make(chan error)
-	go client.Listen(port, errCh)
-	// Check if Listen encountered an error starting up net.Listen
-	if err = <- errCh; err != nil {
-		return err
+	// Check for special cases that this username already exists on the server, the server
+	// couldn't use the port we reported, or the server is too busy to accept us
+	switch response.Cmd {
+	case "alreadyExists":
+		err = errors.New(fmt.Sprintf("Error: User '%s' already exists on the server!\n", client.Username))
+	case "invalidPort":
+		err = errors.New(fmt.Sprintf("Error: Server rejected listen port '%s'!\n", port))
+	case "serverFull":
+		err = errors.New(fmt.Sprintf("Error: %s\n", response.Msg))
+	default:
+		if response.Msg != port {
+			// Server recorded a port we aren't listening on, so remove our entry from its AddrMap
+			// rather than leave it with an address that can't be reached. The disconnect is
+			// signed with the token of the session the server started for it
+			client.Token = response.Token
+			client.disconnect(address, response.Msg)
+			err = errors.New(fmt.Sprintf("Error: Server recorded port '%s' but listening on '%s'!\n", response.Msg, port))
+		} else {
+			// Keep the session token so we can reclaim our name if we reconnect
+			client.Token = response.Token
+		}
 	}
-	//Add the global group to cache of client's groups
-	client.MyGroups.Create("global", "")
-	client.MyGroups.AddUser("global", client.Username)
-	
-	return nil
+	return
 }
 
 // Handles the input entered by the Client and creates the Msg to send to the server
 func (client *Client) HandleRequest(input string) {
-    // Split input on whitespace
-	args := strings.Fields(input)
-	if len(args) > 3 {
-		// Join all strings after the first 2 arguments into a single 3rd argument
-		// This will allow messages with spaces to be valid
-		args = []string{args[0], args[1], strings.Join(args[2:], " ")}
-	}
+    // Split input on whitespace, keeping everything after the first 2 arguments as a single
+	// 3rd argument. This will allow messages with spaces to be valid, and quoted arguments
+	// allow group names with spaces
+	args := gochat.SplitArgs(input, 3)
 	// Assign the args to a Msg in the following format:
 	// 0: the Cmd user wants to execute
 	// 1: who the Cmd should be executed on
@@ -97,23 +246,86 @@ func (client *Client) HandleRequest(input string) {
 		//should just be empty string
 		return
 	}
+	client.recordHistory(input)
     // Check what Cmd the user wants and if it's valid
 	// 'groups' and 'users' are commands that access the Client's local cache
 	switch msg.Cmd {
-	case "join", "dm", "leave", "create", "delete", "group", "kick":
+	case "join", "leave", "create", "delete", "group", "kick", "rename", "list", "mod",
+		"usergroups", "validate", "unread", "owner", "slowmode", "pin", "unpin", "pinned",
+		"invite", "invites", "display", "friend", "unfriend",
+		"topgroups", "tempmute", "recent", "help",
+		"freeze", "unfreeze", "owned", "announceowned", "move",
+		"diff", "limit", "report", "reports", "allusers", "promote", "addr", "reply", "afk", "back", "clear",
+		"activity", "delivery":
+		if msg.Cmd == "help" {
+			// The server lists its own commands, so only list ours
+			fmt.Println("Local commands:")
+			for _, command := range localCommands {
+				fmt.Printf(" %s: %s\n", command.Usage, command.Description)
+			}
+		}
 		// Send the message to the server
-		err := msg.Send("localhost:8080")
+		err := client.send(msg)
+		if err != nil {
+			fmt.Println("Error sending msg:", err)
+		}
+	case "dm":
+		// Encrypt the message if we've exchanged keys with the user, so only they can read it
+		if keys, err := client.keyring(); err == nil && keys.HasPeer(msg.To) {
+			if msg.Sealed, err = keys.Seal(msg.To, msg.Msg); err != nil {
+				fmt.Println("Error encrypting msg:", err)
+				break
+			}
+			msg.Msg = ""
+		}
+		if err := client.send(msg); err != nil {
+			fmt.Println("Error sending msg:", err)
+		}
+	case "key":
+		// Send our public key to the user so we can encrypt direct messages to each other
+		keys, err := client.keyring()
 		if err != nil {
+			fmt.Println("Error generating keys:", err)
+			break
+		}
+		msg.Key = keys.Public()
+		if err = client.send(msg); err != nil {
+			fmt.Println("Error sending msg:", err)
+		}
+	case "file":
+		// Send the file at the path in msg.Msg to the group as a group message
+		if msg.To == "" || msg.Msg == "" {
+			fmt.Println("Please enter a group and the path of the file to send.")
+			break
+		}
+		payload, err := ioutil.ReadFile(msg.Msg)
+		if err != nil {
+			fmt.Println("Error reading file:", err)
+			break
+		}
+		if len(payload) > gochat.MaxPayloadSize {
+			fmt.Printf("File %s is larger than the %d byte limit.\n", msg.Msg, gochat.MaxPayloadSize)
+			break
+		}
+		msg.Filename = filepath.Base(msg.Msg)
+		msg.Payload = payload
+		msg.Msg = fmt.Sprintf("sent the file %s", msg.Filename)
+		msg.Cmd = "group"
+		if err = client.send(msg); err != nil {
 			fmt.Println("Error sending msg:", err)
 		}
 	// Local messages
 	case "groups":
-		// Print out all group names
-		groupNames := client.MyGroups.GroupNames()
-		if (len(groupNames) > 0) {
+		// Print out all group names, with how many members we know of in each
+		infos := client.MyGroups.GroupInfos()
+		if (len(infos) > 0) {
 			fmt.Println("Groups:")
-			for _, groupName := range groupNames {
-				fmt.Printf(" * %s\n", groupName)
+			for _, info := range infos {
+				if info.Members == 1 {
+					fmt.Printf(" * %s (1 member)\n", info.Name)
+				} else {
+					fmt.Printf(" * %s (%d members)\n", info.Name, info.Members)
+				}
 			}
 		} else {
 			fmt.Println("You belong to no groups.")
@@ -126,48 +338,196 @@ func (client *Client) HandleRequest(input string) {
 		// Print out all users in the given group
 		if group, ok := client.MyGroups.Get(msg.To); ok {
 			fmt.Printf("Users in %s:\n", msg.To)
-			for _, user := range group.Users.Array() {
+			for _, user := range group.Users.SortedArray() {
 				fmt.Printf(" * %s\n", user)
 			}
 		} else {
 			fmt.Printf("You do not belong to the group %s.\n", msg.To)
 		}
+	case "everyone":
+		// Print out all users in the global group, which everyone is put in when they connect
+		if group, ok := client.MyGroups.Get("global"); ok {
+			users := group.Users.SortedArray()
+			fmt.Printf("Everyone online (%d):\n", len(users))
+			for _, user := range users {
+				fmt.Printf(" * %s\n", user)
+			}
+		} else {
+			fmt.Println("You do not belong to the group global.")
+		}
+	case "export", "import":
+		// Save the cached groups to the file at msg.To, or restore them from it
+		if msg.To == "" {
+			fmt.Printf("Please enter the path of the file to %s groups.\n", msg.Cmd)
+			break
+		}
+		if msg.Cmd == "export" {
+			if err := client.ExportGroups(msg.To); err != nil {
+				fmt.Println("Error exporting groups:", err)
+			} else {
+				fmt.Printf("Groups exported to %s.\n", msg.To)
+			}
+		} else {
+			if err := client.ImportGroups(msg.To); err != nil {
+				fmt.Println("Error importing groups:", err)
+			} else {
+				fmt.Printf("Groups imported from %s.\n", msg.To)
+			}
+		}
+	case "reset":
+		// Drop our cached groups and ask the server for the groups we're in, such as when the
+		// cache has drifted from the server's. We stay connected throughout
+		client.ResetCache()
+		fmt.Println("Cache cleared, resyncing with the server.")
+	case "whoami":
+		// Print who we're connected as, without asking the server
+		fmt.Println(client.WhoAmI())
+	case "uptime":
+		// Print how long we've been connected
+		fmt.Println(client.Uptime())
+	case "status":
+		// Print whether we're connected and to where
+		fmt.Println(client.Status())
+	case "history":
+		// Print out the last n commands, or all of them if n isn't given
+		n := len(client.History)
+		if msg.To != "" {
+			var err error
+			if n, err = strconv.Atoi(msg.To); err != nil || n < 0 {
+				fmt.Println("Please enter how many commands to show.")
+				break
+			}
+		}
+		for i, command := range client.lastHistory(n) {
+			fmt.Printf(" %d %s\n", i+1, command)
+		}
 	default:
 		fmt.Printf("Unknown command '%s'\n", msg.Cmd)
 	}
 }
 
-// Listens on a port given by the server for messages, usually from other Clients
-func (client *Client) Listen(port string, errCh chan error) {
-    addr := fmt.Sprintf("%s:%s", client.Address, port)
-	// Create the net.Listen
-    listen, err := net.Listen("tcp", addr)
-    if err != nil {
-		// Send an error through the channel if one is encountered
-        errCh <- err
-		close(errCh)
-		return
-    }
-	// Close the error channel so Connect can continue
-	close(errCh)
-    defer listen.Close()
-    fmt.Println("Listening on port", port)
-    for {
-		// Blocks until a message is received
-        conn, err := listen.Accept()
-        if err != nil {
-            continue
-        }
+// Adds the command to the Client's History, dropping the oldest command once it is full
+func (client *Client) recordHistory(command string) {
+	client.History = append(client.History, strings.TrimSpace(command))
+	if len(client.History) > maxHistory {
+		client.History = client.History[len(client.History)-maxHistory:]
+	}
+}
+
+// Returns the last n commands in the Client's History, oldest first
+func (client *Client) lastHistory(n int) []string {
+	if n > len(client.History) {
+		n = len(client.History)
+	}
+	return client.History[len(client.History)-n:]
+}
+
+// Listens on the Client's bound listener for messages, usually from other Clients
+func (client *Client) Listen(listener gochat.MsgListener) {
+    defer listener.Close()
+	// Blocks until a message is received
+    for response := range listener.Msgs() {
 		// call goroutine of HandlerResponse to handle the server message
-        go client.HandleResponse(conn)
+        go client.HandleResponse(response)
     }
+	// The listener was closed, so we can't receive anything until we connect again
+	client.listenerLock.Lock()
+	if client.listener == listener {
+		client.listener = nil
+	}
+	client.listenerLock.Unlock()
 }
 
-// Determines how to process a message received as a response from the server and what to output
-func (client *Client) HandleResponse(conn net.Conn) {
+// Returns a description of the name the Client is connected as, the name it's shown by if it
+// has set one, and the server it's connected to
+func (client *Client) WhoAmI() string {
+	whoami := fmt.Sprintf("You are %s", client.Username)
+	if client.DisplayName != "" && client.DisplayName != client.Username {
+		whoami += fmt.Sprintf(" (shown as %s)", client.DisplayName)
+	}
+	client.listenerLock.Lock()
+	connected := client.listener != nil
+	client.listenerLock.Unlock()
+	if connected {
+		return whoami + fmt.Sprintf(", connected to %s.", client.Server)
+	}
+	return whoami + ", not connected."
+}
+
+// Returns how long the Client has been connected to the server, or that it isn't connected
+func (client *Client) Uptime() string {
+	client.listenerLock.Lock()
+	connected := client.listener != nil
+	connectedAt := client.connectedAt
+	client.listenerLock.Unlock()
+	if !connected {
+		return "Not connected."
+	}
+	return fmt.Sprintf("Connected to %s for %s.", client.Server, time.Since(connectedAt).Round(time.Second))
+}
+
+// Returns a description of whether the Client is connected, the server and port it's connected
+// with, and how many groups it has cached
+func (client *Client) Status() string {
+	client.listenerLock.Lock()
+	listener := client.listener
+	client.listenerLock.Unlock()
+	status := "Not connected."
+	if listener != nil {
+		status = fmt.Sprintf("Connected to %s as %s.", client.Server, client.Username)
+		if _, port, err := net.SplitHostPort(listener.Addr()); err == nil {
+			status += fmt.Sprintf("\nListening on port %s.", port)
+		}
+	}
+	groupCount := client.MyGroups.Count()
+	if groupCount == 1 {
+		return status + "\n1 cached group."
+	}
+	return status + fmt.Sprintf("\n%d cached groups.", groupCount)
+}
+
+// Asks the server at the given address for its health, such as from a load balancer or uptime
+// probe, giving up after timeout. Returns the server's status, which starts with OK if it's
+// healthy, followed by how many users, groups, and connections it has
+func CheckHealth(address string, timeout time.Duration) (status string, err error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return
+	}
 	defer conn.Close()
-    response := &gochat.Msg{}
-    response.Retrieve(conn)
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	if err = gob.NewEncoder(conn).Encode(&gochat.Msg{Cmd: "health"}); err != nil {
+		return
+	}
+	response := &gochat.Msg{}
+	if err = response.Retrieve(conn); err != nil {
+		return
+	}
+	if response.Cmd == "serverFull" {
+		// The server turned the connection away before reading it
+		return fmt.Sprintf("OVERLOADED %s", response.Msg), nil
+	}
+	return response.Msg, nil
+}
+
+// Returns the Dialer used for the 'init' handshake, which is the Client's Transport when it can
+// dial connections itself
+func (client *Client) dialer() gochat.Dialer {
+	if dialer, ok := client.Transport.(gochat.Dialer); ok {
+		return dialer
+	}
+	return gochat.DefaultDialer
+}
+
+// Determines how to process a message received as a response from the server and what to output
+func (client *Client) HandleResponse(response *gochat.Msg) {
+	// Skip messages we've already received, such as ones replayed after reconnecting. The first
+	// copy was already acked or receipted
+	if (response.Cmd == "group" || response.Cmd == "dm") && response.ID != "" && !client.seen.Add(response.ID) {
+		return
+	}
 	// Decisions of how to update local cache based on type of response message
 	if response.User == client.Username {
 		// Responses from the server from messages we sent
@@ -181,6 +541,28 @@ func (client *Client) HandleResponse(conn net.Conn) {
 			// We created or joined a group, so create a local copy of it
 			client.MyGroups.Create(response.To, "")
 			client.MyGroups.AddUser(response.To, response.User)
+		case "rename":
+			// We renamed a group, so move our local copy to its new name
+			client.renameGroup(response)
+		case "pin", "unpin":
+			// We changed a group's pinned message, or joined a group with one
+			client.pinGroup(response)
+		case "diff":
+			// The server sent a group's members, so compare our local copy to them
+			client.diffGroup(response)
+		case "clear":
+			// We cleared a group's history, so forget its messages too
+			client.seen.ForgetGroup(response.To)
+		case "display":
+			// We changed the name we're shown by, so use it if we reconnect
+			client.DisplayName = response.To
+		case "unread":
+			// How many messages we haven't seen in each of our groups
+			if response.Msg != "" {
+				response.Msg = fmt.Sprintf("Unread: %s", response.Msg)
+			} else {
+				response.Msg = "No unread messages."
+			}
 		}
 	} else {
 		// Responses from the server from messages other clients sent
@@ -192,21 +574,269 @@ func (client *Client) HandleResponse(conn net.Conn) {
 			// A group was deleted, so delete our local copy
 			client.MyGroups.Delete(response.To)
 		case "join":
-			// A user joined a group we're in, so update our local copy
+			// A user joined a group we're in, so update our local copy. We may not have it yet
+			// if we just connected from another device
+			client.MyGroups.Create(response.To, "")
 			client.MyGroups.AddUser(response.To, response.User)
+		case "rename":
+			// A group we're in was renamed, so move our local copy to its new name
+			client.renameGroup(response)
+		case "pin", "unpin":
+			// A group we're in had its pinned message changed, so update our local copy
+			client.pinGroup(response)
+		case "clear":
+			// A group we're in had its history cleared, so forget its messages too
+			client.seen.ForgetGroup(response.To)
+		case "read":
+			// A user read a direct message we sent them
+			response.Msg = fmt.Sprintf("✓ read by %s", response.User)
+		case "key":
+			// A user sent us their public key
+			client.exchangeKeys(response)
+		case "dm":
+			// A user sent us a direct message, which may be encrypted
+			if len(response.Sealed) > 0 {
+				client.openDM(response)
+			}
 		}
 	}
+	// Remember what group messages said, including our own as the server echoes them back, so
+	// replies to them can show it
+	groupMsg := response.ID != "" && (response.Cmd == "group" || response.Cmd == "")
+	if groupMsg {
+		client.seen.SetText(response.ID, response.To, response.Msg)
+	}
+	if response.ReplyTo != "" && response.Msg != "" {
+		if parent, ok := client.seen.Text(response.ReplyTo); ok {
+			response.Msg += fmt.Sprintf("\n  ↳ in reply to %s", parent)
+		} else {
+			response.Msg += fmt.Sprintf("\n  ↳ in reply to message #%s", response.ReplyTo)
+		}
+	}
+	if client.ShowIDs && groupMsg {
+		response.Msg = fmt.Sprintf("#%s %s", response.ID, response.Msg)
+	}
 	// Only print if we have a message
 	if response.Msg != "" {
 		fmt.Printf("%s\n", response.Msg)
 	}
+	// Save any file that was sent to us
+	if len(response.Payload) > 0 {
+		if path, err := client.saveDownload(response.Filename, response.Payload); err != nil {
+			fmt.Println("Error saving file:", err)
+		} else {
+			fmt.Printf("[%s] Saved %s from %s to %s\n", response.To, response.Filename, response.User, path)
+		}
+	}
+	// Let the server know we received a group message
+	if response.Cmd == "group" && response.ID != "" && response.User != client.Username {
+		ack := &gochat.Msg{User: client.Username, To: response.To, Cmd: "ack", ID: response.ID}
+		if err := client.send(ack); err != nil {
+			fmt.Println("Error sending ack:", err)
+		}
+	}
+	// Now that a direct message has been displayed, let its sender know we read it
+	if response.Cmd == "dm" && response.ID != "" && response.User != client.Username {
+		receipt := &gochat.Msg{User: client.Username, To: response.User, Cmd: "read", ID: response.ID}
+		if err := client.send(receipt); err != nil {
+			fmt.Println("Error sending read receipt:", err)
+		}
+	}
+}
+
+// Writes a received file to the Client's Downloads directory, returning where it was saved.
+// Only the base of the filename is used, so senders can't write outside the directory
+func (client *Client) saveDownload(filename string, payload []byte) (path string, err error) {
+	filename = filepath.Base(filename)
+	if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+		filename = "download"
+	}
+	if err = os.MkdirAll(client.Downloads, 0755); err != nil {
+		return
+	}
+	path = filepath.Join(client.Downloads, filename)
+	err = ioutil.WriteFile(path, payload, 0644)
+	return
+}
+
+// Constructor function for recentIDs, remembering up to size IDs
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{ids: make([]string, size), set: make(map[string]bool), texts: make(map[string]shownMsg)}
+}
+
+// Adds the ID, forgetting the oldest one if full. Returns false if the ID was already added
+func (recent *recentIDs) Add(id string) bool {
+	recent.lock.Lock()
+	defer recent.lock.Unlock()
+	if recent.set[id] {
+		return false
+	}
+	if oldest := recent.ids[recent.next]; oldest != "" {
+		delete(recent.set, oldest)
+		delete(recent.texts, oldest)
+	}
+	recent.ids[recent.next] = id
+	recent.next = (recent.next + 1) % len(recent.ids)
+	recent.set[id] = true
+	return true
+}
+
+// Records what the message with the ID sent to the group said, first adding the ID if it isn't
+// remembered
+func (recent *recentIDs) SetText(id, group, text string) {
+	recent.Add(id)
+	recent.lock.Lock()
+	if recent.set[id] {
+		recent.texts[id] = shownMsg{group, text}
+	}
+	recent.lock.Unlock()
+}
+
+// Returns what the message with the ID said, and a boolean if it's remembered
+func (recent *recentIDs) Text(id string) (text string, ok bool) {
+	recent.lock.Lock()
+	shown, ok := recent.texts[id]
+	recent.lock.Unlock()
+	return shown.text, ok
+}
+
+// Forgets what every message sent to the group said, such as once its history is cleared. The
+// IDs are still remembered so duplicates are skipped
+func (recent *recentIDs) ForgetGroup(group string) {
+	recent.lock.Lock()
+	for id, shown := range recent.texts {
+		if shown.group == group {
+			delete(recent.texts, id)
+		}
+	}
+	recent.lock.Unlock()
+}
+
+// Moves the cached group in a 'rename' response to its new name and sets the message to print
+// NOTE: The new group name will be in response.Msg
+func (client *Client) renameGroup(response *gochat.Msg) {
+	client.MyGroups.Rename(response.To, response.Msg)
+	response.Msg = fmt.Sprintf("[%s] Group %s has been renamed to %s.", response.Msg, response.To, response.Msg)
+}
+
+// Returns the Client's keyring for encrypting direct messages, generating its key pair the
+// first time it's needed
+func (client *Client) keyring() (*keyring, error) {
+	client.keysOnce.Do(func() {
+		client.keys, client.keysErr = newKeyring()
+	})
+	return client.keys, client.keysErr
+}
+
+// Records the public key in a 'key' response and sets the message to print. If the key is new,
+// our key is sent back so the user can encrypt messages to us too
+// NOTE: The key will be in response.Key
+func (client *Client) exchangeKeys(response *gochat.Msg) {
+	keys, err := client.keyring()
+	if err != nil {
+		response.Msg = fmt.Sprintf("Error generating keys: %s", err)
+		return
+	}
+	changed, err := keys.AddPeer(response.User, response.Key)
+	if err != nil {
+		response.Msg = fmt.Sprintf("Invalid key from %s: %s", response.User, err)
+		return
+	}
+	if !changed {
+		return
+	}
+	reply := &gochat.Msg{User: client.Username, To: response.User, Cmd: "key", Key: keys.Public()}
+	if err = client.send(reply); err != nil {
+		fmt.Println("Error sending key:", err)
+	}
+	response.Msg = fmt.Sprintf("Exchanged keys with %s, direct messages between you are now encrypted.", response.User)
+}
+
+// Decrypts an encrypted 'dm' response and sets the message to print
+// NOTE: The server will have put who the message is from in response.Msg
+func (client *Client) openDM(response *gochat.Msg) {
+	keys, err := client.keyring()
+	if err == nil {
+		var text string
+		if text, err = keys.Open(response.User, response.Sealed); err == nil {
+			response.Msg = fmt.Sprintf("%s %s", response.Msg, text)
+			return
+		}
+	}
+	response.Msg = fmt.Sprintf("%s a message that couldn't be decrypted: %s", response.Msg, err)
+}
+
+// Updates the pinned message of the cached group in a 'pin' or 'unpin' response and sets the
+// message to print
+// NOTE: The pinned message will be in response.Msg
+func (client *Client) pinGroup(response *gochat.Msg) {
+	client.MyGroups.SetPin(response.To, response.Msg)
+	if response.Cmd == "unpin" {
+		response.Msg = fmt.Sprintf("[%s] The pinned message was removed.", response.To)
+	} else {
+		response.Msg = fmt.Sprintf("[%s] Pinned: %s", response.To, response.Msg)
+	}
+}
+
+// Calls HandleRequest for each line read from input until the user types 'q', 'quit', or 'exit',
+// or input ends, then disconnects from the Client's server. Returns the error that stopped
+// reading input, if it wasn't the end of it
+// NOTE: Checking Scan's result means piped input that runs out stops the Client instead of
+//       feeding it empty lines forever
+func (client *Client) ReadInput(input io.Reader) error {
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "q" || line == "quit" || line == "exit" {
+			break
+		}
+		client.HandleRequest(line)
+	}
+	client.Disconnect(client.Server)
+	return scanner.Err()
 }
 
 // Sends a message to the server saying the Client is disconnecting
 func (client *Client) Disconnect(server string) {
-	request := &gochat.Msg{User: client.Username, Cmd: "disconnect"}
-	err := request.Send(server)
+	// Report the port we're listening on so the server only ends this device's session
+	port := ""
+	client.listenerLock.Lock()
+	if server == client.Server && client.listener != nil {
+		_, port, _ = net.SplitHostPort(client.listener.Addr())
+	}
+	client.listenerLock.Unlock()
+	client.disconnect(server, port)
+	// Stop listening if we're disconnecting from the server we're connected to
+	if server == client.Server {
+		client.listenerLock.Lock()
+		if client.listener != nil {
+			client.listener.Close()
+		}
+		client.listenerLock.Unlock()
+	}
+}
+
+// Sends the 'disconnect' message for the session the server recorded at the given port. An
+// empty port disconnects all of the Client's sessions
+func (client *Client) disconnect(server, port string) {
+	request := &gochat.Msg{User: client.Username, Msg: port, Cmd: "disconnect"}
+	client.sign(request)
+	err := client.Transport.Send(server, request)
 	if err != nil {
 		fmt.Println("Error sending disconnect:", err)
 	}
+}
+
+// Signs the message and sends it to the Client's server
+func (client *Client) send(msg *gochat.Msg) error {
+	client.sign(msg)
+	return client.Transport.Send(client.Server, msg)
+}
+
+// Signs the message with our session token, so a server requiring signatures knows it's from
+// us. Messages are sent unsigned before the server has issued us a token
+func (client *Client) sign(msg *gochat.Msg) {
+	if client.Token != "" {
+		msg.Sign([]byte(client.Token))
+	}
 }
\ No newline at end of file
@@ -0,0 +1,87 @@
+package clnt
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"github.com/zembrodt/gochat"
+)
+
+func TestConnectClosedPort(t *testing.T) {
+	// Find a port nothing is listening on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	client := NewClient("ryan", nil)
+	client.Address = "127.0.0.1"
+	if err := client.Connect(addr); err == nil {
+		t.Errorf("Connect to %s, which nothing is listening on, didn't return an error", addr)
+	}
+	if client.Server != "" {
+		t.Errorf("Client remembered %s as its server after failing to connect", client.Server)
+	}
+}
+
+// Reader that returns its error once its input has been read
+type failingReader struct {
+	input io.Reader
+	err error
+}
+
+func (reader *failingReader) Read(p []byte) (int, error) {
+	n, err := reader.input.Read(p)
+	if err == io.EOF {
+		return n, reader.err
+	}
+	return n, err
+}
+
+func TestReadInput(t *testing.T) {
+	dialer := gochat.NewPipeDialer()
+	received := make(chan *gochat.Msg, 10)
+	dialer.Handle("server", func(conn net.Conn) {
+		defer conn.Close()
+		msg := &gochat.Msg{}
+		if err := msg.Retrieve(conn); err == nil {
+			received <- msg
+		}
+	})
+	failed := errors.New("input failed")
+	tests := []struct {
+		name string
+		input io.Reader
+		want error
+	}{
+		{"quit", strings.NewReader("\n\nquit\njoin team\n"), nil},
+		{"end of input", strings.NewReader("\n"), nil},
+		{"input error", &failingReader{strings.NewReader("\n"), failed}, failed},
+	}
+	for _, test := range tests {
+		client := NewClient("ryan", &gochat.TCPTransport{Dialer: dialer})
+		client.Server = "server"
+		done := make(chan error, 1)
+		go func() { done <- client.ReadInput(test.input) }()
+		select {
+		case err := <-done:
+			if err != test.want {
+				t.Errorf("%s: ReadInput returned %v, want %v", test.name, err, test.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: ReadInput never returned", test.name)
+		}
+		select {
+		case msg := <-received:
+			if msg.Cmd != "disconnect" {
+				t.Errorf("%s: server was sent %s, want disconnect", test.name, msg.Cmd)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: server was never sent a disconnect", test.name)
+		}
+	}
+}
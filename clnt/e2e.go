@@ -0,0 +1,107 @@
+package clnt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// End-to-end encryption of direct messages. Clients exchange Curve25519 public keys through the
+// server with the 'key' command, then seal each direct message to a user whose key they have
+// with NaCl's box, sending a random 24 byte nonce followed by the box. The server relays the
+// sealed message without being able to read it, and any client with a NaCl implementation can
+// open it.
+// NOTE: Keys aren't verified, so this doesn't protect against a server that swaps them
+
+// Size of the nonce sent in front of each sealed message
+const nonceSize = 24
+
+// A Client's key pair and the public keys of the users it has exchanged keys with
+type keyring struct {
+	public, private *[32]byte
+	peers map[string]*[32]byte
+	lock sync.RWMutex
+}
+
+// Constructor function for keyring, generating a new key pair
+func newKeyring() (*keyring, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &keyring{public: public, private: private, peers: make(map[string]*[32]byte)}, nil
+}
+
+// Returns our public key to send to other users
+func (keys *keyring) Public() []byte {
+	return append([]byte{}, keys.public[:]...)
+}
+
+// Records the user's public key. Returns true if it's new or changed
+func (keys *keyring) AddPeer(user string, key []byte) (changed bool, err error) {
+	if len(key) != 32 {
+		return false, errors.New(fmt.Sprintf("Public key for user %s is %d bytes, not 32.", user, len(key)))
+	}
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+	if old, ok := keys.peers[user]; ok && bytes.Equal(old[:], key) {
+		return false, nil
+	}
+	public := new([32]byte)
+	copy(public[:], key)
+	keys.peers[user] = public
+	return true, nil
+}
+
+// Returns if we have the user's public key
+func (keys *keyring) HasPeer(user string) bool {
+	keys.lock.RLock()
+	_, ok := keys.peers[user]
+	keys.lock.RUnlock()
+	return ok
+}
+
+// Returns the user's public key
+func (keys *keyring) peer(user string) (*[32]byte, error) {
+	keys.lock.RLock()
+	public, ok := keys.peers[user]
+	keys.lock.RUnlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No key for user %s.", user))
+	}
+	return public, nil
+}
+
+// Encrypts the text for the user, returning a random nonce followed by the box
+func (keys *keyring) Seal(user, text string) ([]byte, error) {
+	public, err := keys.peer(user)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [nonceSize]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return box.Seal(nonce[:], []byte(text), &nonce, public, keys.private), nil
+}
+
+// Decrypts a message sealed for us by the user
+func (keys *keyring) Open(user string, sealed []byte) (string, error) {
+	public, err := keys.peer(user)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < nonceSize+box.Overhead {
+		return "", errors.New("Sealed message is too short.")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed)
+	text, ok := box.Open(nil, sealed[nonceSize:], &nonce, public, keys.private)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Message from user %s couldn't be decrypted.", user))
+	}
+	return string(text), nil
+}
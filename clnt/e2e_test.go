@@ -0,0 +1,76 @@
+package clnt
+
+import (
+	"crypto/rand"
+	"testing"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestKeyring(t *testing.T) {
+	ryan, err := newKeyring()
+	if err != nil {
+		t.Fatalf("newKeyring: %s", err)
+	}
+	mike, err := newKeyring()
+	if err != nil {
+		t.Fatalf("newKeyring: %s", err)
+	}
+	if _, err := ryan.Seal("mike", "hi"); err == nil {
+		t.Error("Seal to a user without a key didn't return an error")
+	}
+	if _, err := ryan.AddPeer("mike", []byte("short")); err == nil {
+		t.Error("AddPeer with a 5 byte key didn't return an error")
+	}
+	if changed, err := ryan.AddPeer("mike", mike.Public()); !changed || err != nil {
+		t.Errorf("AddPeer of a new key = %v, %v, want true, nil", changed, err)
+	}
+	if changed, err := ryan.AddPeer("mike", mike.Public()); changed || err != nil {
+		t.Errorf("AddPeer of the same key = %v, %v, want false, nil", changed, err)
+	}
+	if _, err := mike.AddPeer("ryan", ryan.Public()); err != nil {
+		t.Fatalf("AddPeer: %s", err)
+	}
+
+	sealed, err := ryan.Seal("mike", "hello")
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	if text, err := mike.Open("ryan", sealed); err != nil || text != "hello" {
+		t.Errorf("Open = %q, %v, want \"hello\", nil", text, err)
+	}
+
+	// The sealed message is a 24 byte nonce followed by a standard NaCl box
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	var ryanPublic [32]byte
+	copy(ryanPublic[:], ryan.Public())
+	if text, ok := box.Open(nil, sealed[24:], &nonce, &ryanPublic, mike.private); !ok || string(text) != "hello" {
+		t.Errorf("box.Open of a sealed message = %q, %v, want \"hello\", true", text, ok)
+	}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		t.Fatalf("rand.Read: %s", err)
+	}
+	var mikePublic [32]byte
+	copy(mikePublic[:], mike.Public())
+	boxed := box.Seal(append([]byte{}, nonce[:]...), []byte("from nacl"), &nonce, &mikePublic, ryan.private)
+	if text, err := mike.Open("ryan", boxed); err != nil || text != "from nacl" {
+		t.Errorf("Open of a box.Seal message = %q, %v, want \"from nacl\", nil", text, err)
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := mike.Open("ryan", tampered); err == nil {
+		t.Error("Open of a tampered message didn't return an error")
+	}
+	if _, err := mike.Open("ryan", sealed[:20]); err == nil {
+		t.Error("Open of a truncated message didn't return an error")
+	}
+	eve, err := newKeyring()
+	if err != nil {
+		t.Fatalf("newKeyring: %s", err)
+	}
+	eve.AddPeer("ryan", ryan.Public())
+	if _, err := eve.Open("ryan", sealed); err == nil {
+		t.Error("Open with the wrong key didn't return an error")
+	}
+}
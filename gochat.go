@@ -10,71 +10,314 @@ package gochat
 import (
 	"fmt"
 	"net"
+	"errors"
+	"io"
+	"sort"
 	"sync"
+	"time"
 	"encoding/gob"
 	"github.com/zembrodt/gochat/strset"
 )
 
-// A message is broken into 4 parts
-// User: The user sending the message
-// To:   Who we're sending that message to
-// Msg:  The contents of the message
-// Cmd:  The command we'll execute on the server
+// A message is broken into 14 parts
+// User:     The user sending the message
+// To:       Who we're sending that message to
+// Msg:      The contents of the message
+// Cmd:      The command we'll execute on the server
+// ID:       Identifies the message, assigned by the server
+// Token:    The user's session token, issued by the server on 'init'
+// Payload:  An attached file, up to MaxPayloadSize bytes
+// Filename: The name of the attached file
+// Sealed:   The contents of an end-to-end encrypted message, which the server can't read
+// Key:      The sender's public key, exchanged with the 'key' command
+// Signature: HMAC of the other parts, made with Sign when the server requires signatures
+// ReplyTo:  The ID of the group message this one replies to, if any
+// SignedAt: When the message was signed, in Unix nanoseconds
+// Nonce:    Random bytes set by Sign, so each signed message is unique and can't be replayed
 type Msg struct {
 	User, To, Msg, Cmd string
+	ID string
+	Token string
+	Payload []byte
+	Filename string
+	Sealed []byte
+	Key []byte
+	Signature []byte
+	ReplyTo string
+	SignedAt int64
+	Nonce []byte
 }
 
 type Addr struct {
 	Address, Port string
 }
 
-// Defined who owns a group and what users are in the group. Needed for GroupMap
+// Defined who owns a group, what users are in the group, which of them moderate it or are
+// away from it, how often each member may send a message to it, what message is pinned in it,
+// whether it's frozen, and how many members it may have. Needed for GroupMap
 type Group struct {
 	Owner string
 	Users *strset.AtomicStringSet
+	Mods *strset.AtomicStringSet
+	Away *strset.AtomicStringSet // members who stepped away, who aren't sent its messages
+	SlowMode time.Duration // minimum time between a member's messages, 0 if unlimited
+	Pinned string // message pinned by the owner or a moderator, empty if there isn't one
+	Frozen bool // whether only the owner can send messages to it
+	Limit int // most members it may have, 0 if unlimited
 }
 
-// Keeps track of an Addr for each user. Thread-safe
+// Constructor function for Group, with no users or moderators. A Group's sets should always
+// be made this way, though GroupMap copes with groups whose sets are nil
+func NewGroup(owner string) Group {
+	return Group{Owner: owner, Users: strset.NewAtomicStringSet(), Mods: strset.NewAtomicStringSet(), Away: strset.NewAtomicStringSet()}
+}
+
+// Returns if any of the group's sets are nil
+func (group Group) missingSets() bool {
+	return group.Users == nil || group.Mods == nil || group.Away == nil
+}
+
+// Keeps track of the Addrs of each user's sessions, as a user can be connected from multiple
+// devices at once. Thread-safe
 type AddrMap struct {
-    v map[string]Addr
+    v map[string][]Addr // each user's session addresses, oldest first
     lock sync.RWMutex // can be held by an arbitrary amount of readers and one writer
 }
 
+// A copy of a group as it was when exported by GroupMap.Export, which can be saved as JSON and
+// restored with GroupMap.Import
+type GroupState struct {
+	Name string `json:"name"`
+	Owner string `json:"owner"`
+	Users []string `json:"users"`
+	Mods []string `json:"mods,omitempty"`
+	Away []string `json:"away,omitempty"`
+	SlowMode time.Duration `json:"slowMode,omitempty"`
+	Pinned string `json:"pinned,omitempty"`
+	Frozen bool `json:"frozen,omitempty"`
+	Limit int `json:"limit,omitempty"`
+}
+
+// Summary of a group, as listed by GroupMap.GroupInfos
+type GroupInfo struct {
+	Name, Owner string
+	Members int // how many users are in the group
+}
+
+// The outcome of adding a user to a group with GroupMap.AddUser
+type AddResult int
+
+const (
+	Added AddResult = iota // the user was added to the group
+	AlreadyMember // the user was already in the group
+	NoSuchGroup // the group doesn't exist
+)
+
 // Keeps track of each group's owner and users. Thread-safe
 type GroupMap struct {
 	v map[string]Group
+	userGroups map[string]*strset.StringSet // reverse index of each user's group names
+	ownedGroups map[string]*strset.StringSet // reverse index of the names of the groups each user owns
     lock sync.RWMutex
 }
 
+// Dials the connections a Msg is sent over. It is satisfied by *net.Dialer, and can be
+// swapped out so messages travel over an in-memory transport such as net.Pipe instead
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// The Dialer used by Msg.Send
+var DefaultDialer Dialer = &net.Dialer{}
+
+// How long Msg.Retrieve waits for a full message before giving up. 0 waits forever
+var RetrieveTimeout = 5 * time.Second
+
+// Returned by Msg.Retrieve when the message wasn't received within RetrieveTimeout
+var ErrTimeout = errors.New("timed out retrieving message")
+
+// How long sending a Msg waits for the receiver to take it before giving up, so a slow
+// receiver can't hold up the sender. 0 waits forever
+var SendTimeout = 5 * time.Second
+
+// Returned when sending a Msg when the receiver didn't take it within SendTimeout
+var ErrSendTimeout = errors.New("timed out sending message")
+
+// Largest file that can be attached to a Msg, in bytes
+var MaxPayloadSize = 1 << 20
+
+// Room allowed for the rest of a Msg on top of its payload when retrieving it
+const msgOverhead = 64 << 10
+
+// Returned when sending or retrieving a Msg whose payload is larger than MaxPayloadSize
+var ErrTooLarge = errors.New("message payload too large")
+
+// How Msg.SendWithRetry retries dialing when it fails
+type SendOptions struct {
+	Retries int // how many more times to dial after the first failure
+	Backoff time.Duration // how long to wait before the first retry, doubling after each one
+}
+
+// SendOptions that retry a failed dial a few times over about a second
+var DefaultSendOptions = SendOptions{Retries: 3, Backoff: 100 * time.Millisecond}
+
+// Period between TCP keepalive probes on the connections messages are sent and received over,
+// letting the OS detect half-open connections. 0 disables keepalives
+var KeepAlivePeriod = 30 * time.Second
+
+// Dialer that connects to in-memory handlers through net.Pipe rather than the network.
+// Each dial runs the handler registered for the address in its own goroutine with the
+// other end of the pipe. This allows Server.HandleRequest and Client.HandleResponse to be
+// exercised without binding ports, e.g.:
+//
+//	dialer := gochat.NewPipeDialer()
+//	server := svr.NewServer("server", &gochat.TCPTransport{Dialer: dialer})
+//	dialer.Handle("server", server.HandleRequest)
+//	msg := &gochat.Msg{User: "ryan", To: "global", Cmd: "join"}
+//	err := msg.SendWith(dialer, "server")
+type PipeDialer struct {
+	handlers map[string]func(net.Conn)
+	lock sync.RWMutex
+}
+
 // Sends a message to the given address
 func (msg *Msg) Send(addr string) (err error) {
+	return msg.SendWith(DefaultDialer, addr)
+}
+
+// Sends a message to the given address over a connection from the given Dialer
+func (msg *Msg) SendWith(dialer Dialer, addr string) (err error) {
+	if len(msg.Payload) > MaxPayloadSize {
+		return ErrTooLarge
+	}
 	// Dial a connect to remote client
-	conn, err := net.Dial("tcp", addr)
-	defer conn.Close()
+	conn, err := dialer.Dial("tcp", addr)
 	if err != nil {
+		// conn is nil when the dial fails, so there's nothing to close
 		return err
 	}
+	return msg.sendOver(conn)
+}
+
+// Sends a message to the given address over a connection from the given Dialer, retrying the
+// dial with exponential backoff as set by the SendOptions if it fails. Errors that retrying
+// can't fix, such as an invalid address or ErrTooLarge, are returned without retrying
+func (msg *Msg) SendWithRetry(dialer Dialer, addr string, options SendOptions) (err error) {
+	if len(msg.Payload) > MaxPayloadSize {
+		return ErrTooLarge
+	}
+	var conn net.Conn
+	backoff := options.Backoff
+	for attempt := 0; ; attempt++ {
+		if conn, err = dialer.Dial("tcp", addr); err == nil {
+			break
+		}
+		if attempt >= options.Retries || permanentDialError(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return msg.sendOver(conn)
+}
+
+// Returns if the error from dialing can't be fixed by dialing again, such as a malformed
+// address or a host that doesn't exist
+func permanentDialError(err error) bool {
+	var addrErr *net.AddrError
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+	return errors.As(err, &addrErr)
+}
+
+// Sends a message over the connection, then closes it. Returns ErrSendTimeout if it isn't
+// sent within SendTimeout
+func (msg *Msg) sendOver(conn net.Conn) (err error) {
+	defer conn.Close()
+	if err = KeepAlive(conn, KeepAlivePeriod); err != nil {
+		return err
+	}
+	if SendTimeout > 0 {
+		if err = conn.SetWriteDeadline(time.Now().Add(SendTimeout)); err != nil {
+			return err
+		}
+	}
 	// Set up a new encoder to send the msg as a gob
 	encoder := gob.NewEncoder(conn)
 	err = encoder.Encode(msg) // actually sends the message
 	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return ErrSendTimeout
+		}
 		return err
 	}
 	return nil
 }
 
-// Decodes a message from the given connection
+// Enables TCP keepalives on the connection with the given period. Does nothing if the period
+// is 0 or the connection isn't over TCP, such as one from a PipeDialer
+func KeepAlive(conn net.Conn, period time.Duration) (err error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || period <= 0 {
+		return nil
+	}
+	if err = tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
+
+// Decodes a message from the given connection. Returns ErrTimeout if the full message isn't
+// received within RetrieveTimeout, or ErrTooLarge if its payload is over MaxPayloadSize
 func (msg *Msg) Retrieve(conn net.Conn) (err error) {
+	// Stop waiting on senders that stall so they can't tie up the caller forever
+	if RetrieveTimeout > 0 {
+		if err = conn.SetReadDeadline(time.Now().Add(RetrieveTimeout)); err != nil {
+			return err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
 	// Set up a decoder to get the message from the connection
 	// The decoder will block until it has received the full gob
-	decoder := gob.NewDecoder(conn)
+	// Only read as much as the largest message could be, so a huge payload isn't decoded
+	reader := &limitedReader{conn, int64(MaxPayloadSize + msgOverhead)}
+	decoder := gob.NewDecoder(reader)
     err = decoder.Decode(msg) // decodes the message into msg
     if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return ErrTimeout
+		}
+		if reader.remaining <= 0 {
+			return ErrTooLarge
+		}
         return err
     }
+	if len(msg.Payload) > MaxPayloadSize {
+		return ErrTooLarge
+	}
 	return nil
 }
 
+// Reader that fails once more than a set number of bytes have been read from it
+type limitedReader struct {
+	reader io.Reader
+	remaining int64
+}
+
+func (limited *limitedReader) Read(p []byte) (n int, err error) {
+	if limited.remaining <= 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > limited.remaining {
+		p = p[:limited.remaining]
+	}
+	n, err = limited.reader.Read(p)
+	limited.remaining -= int64(n)
+	return
+}
+
 // Converts an Addr to a string
 func (addr *Addr) String() (string) {
 	return fmt.Sprintf("%s:%s", addr.Address, addr.Port)
@@ -82,31 +325,98 @@ func (addr *Addr) String() (string) {
 
 // Constructor function for AddrMap
 func NewAddrMap() *AddrMap {
-	return &AddrMap{v: make(map[string]Addr)}
+	return &AddrMap{v: make(map[string][]Addr)}
 }
 
-// Returns the Addr associated with the given user, and a boolean if that user exists
+// Returns the Addr of the given user's most recent session, and a boolean if that user exists
 func (addrMap *AddrMap) Get(user string) (addr Addr, ok bool) {
 	addrMap.lock.RLock()
-	addr, ok = addrMap.v[user]
+	addrs, ok := addrMap.v[user]
+	if ok {
+		addr = addrs[len(addrs)-1]
+	}
 	addrMap.lock.RUnlock()
 	return
 }
 
-// Adds an entry into the AddrMap unless the user already exists, which will return false
-func (addrMap *AddrMap) Add(user string, addr Addr) (ok bool) {
+// Returns the Addrs of all the given user's sessions, oldest first
+func (addrMap *AddrMap) All(user string) (addrs []Addr) {
+	addrMap.lock.RLock()
+	addrs = append(addrs, addrMap.v[user]...)
+	addrMap.lock.RUnlock()
+	return
+}
+
+// Returns if the given user has an Addr, without copying it
+func (addrMap *AddrMap) Online(user string) (ok bool) {
 	addrMap.lock.RLock()
 	_, ok = addrMap.v[user]
 	addrMap.lock.RUnlock()
-	if !ok {
-		addrMap.lock.Lock()
-		addrMap.v[user] = addr
-		addrMap.lock.Unlock()
+	return
+}
+
+// Converts the users in the map into a string slice
+func (addrMap *AddrMap) Users() (users []string) {
+	addrMap.lock.RLock()
+	for user, _ := range addrMap.v {
+		users = append(users, user)
 	}
+	addrMap.lock.RUnlock()
+	return
+}
+
+// Returns how many users are in the map
+func (addrMap *AddrMap) Count() (count int) {
+	addrMap.lock.RLock()
+	count = len(addrMap.v)
+	addrMap.lock.RUnlock()
+	return
+}
+
+// Adds a session at the given Addr for the user. Returns true if it's the user's first session,
+// and false if they were already connected
+func (addrMap *AddrMap) Add(user string, addr Addr) (first bool) {
+	addrMap.lock.Lock()
+	addrs, ok := addrMap.v[user]
+	for _, existing := range addrs {
+		if existing == addr {
+			// Already have a session at this Addr
+			addrMap.lock.Unlock()
+			return false
+		}
+	}
+	addrMap.v[user] = append(addrs, addr)
+	addrMap.lock.Unlock()
 	return !ok
 }
 
-// Removes the given user from the AddrMap if they exist
+// Sets the user's Addr, replacing all the sessions they already had
+func (addrMap *AddrMap) Set(user string, addr Addr) {
+	addrMap.lock.Lock()
+	addrMap.v[user] = []Addr{addr}
+	addrMap.lock.Unlock()
+}
+
+// Removes the user's session at the given Addr if they have one. Returns whether it was
+// removed, and whether it was the user's last session, leaving them out of the AddrMap
+func (addrMap *AddrMap) RemoveAddr(user string, addr Addr) (ok, last bool) {
+	addrMap.lock.Lock()
+	defer addrMap.lock.Unlock()
+	addrs := addrMap.v[user]
+	for i, existing := range addrs {
+		if existing == addr {
+			if len(addrs) == 1 {
+				delete(addrMap.v, user)
+				return true, true
+			}
+			addrMap.v[user] = append(addrs[:i], addrs[i+1:]...)
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// Removes the given user and all their sessions from the AddrMap if they exist
 func (addrMap *AddrMap) Remove(user string) (ok bool) {
 	// Check that the map contains the user, so if it doesn't we're only having to use
 	// a read lock and not a write lock.
@@ -121,9 +431,33 @@ func (addrMap *AddrMap) Remove(user string) (ok bool) {
 	return
 }
 
+// Returns a copy of every user's Addrs, taken under the read lock so it's consistent
+func (addrMap *AddrMap) Export() (addrs map[string][]Addr) {
+	addrMap.lock.RLock()
+	addrs = make(map[string][]Addr, len(addrMap.v))
+	for user, userAddrs := range addrMap.v {
+		addrs[user] = append([]Addr(nil), userAddrs...)
+	}
+	addrMap.lock.RUnlock()
+	return
+}
+
+// Replaces every user's Addrs with the given ones, such as from Export. Users without any
+// Addrs are skipped
+func (addrMap *AddrMap) Import(addrs map[string][]Addr) {
+	addrMap.lock.Lock()
+	addrMap.v = make(map[string][]Addr, len(addrs))
+	for user, userAddrs := range addrs {
+		if len(userAddrs) > 0 {
+			addrMap.v[user] = append([]Addr(nil), userAddrs...)
+		}
+	}
+	addrMap.lock.Unlock()
+}
+
 // Constructor function for GroupMap
 func NewGroupMap() *GroupMap {
-	return &GroupMap{v: make(map[string]Group)}
+	return &GroupMap{v: make(map[string]Group), userGroups: make(map[string]*strset.StringSet), ownedGroups: make(map[string]*strset.StringSet)}
 }
 
 // Returns the Group associated with the given group name, and a boolean if that group exists
@@ -131,37 +465,175 @@ func (groupMap *GroupMap) Get(groupId string) (group Group, ok bool) {
 	groupMap.lock.RLock()
 	group, ok = groupMap.v[groupId]
 	groupMap.lock.RUnlock()
+	if ok && group.missingSets() {
+		// Callers expect to be able to use the sets, so give the stored group some
+		groupMap.lock.Lock()
+		group, ok = groupMap.repair(groupId)
+		groupMap.lock.Unlock()
+	}
 	return
 }
 
-// Adds a user to the given group. Returns false if group doesn't exist
-func (groupMap *GroupMap) AddUser(group, user string) (ok bool) {
-	groupMap.lock.RLock()
-	if _, ok = groupMap.v[group]; ok {
-		ok = groupMap.v[group].Users.Contains(user)
-		ok = !ok
+// Returns the given group, first giving it empty sets in place of any that are nil, such as
+// in a Group that wasn't made with NewGroup. The write lock must be held
+func (groupMap *GroupMap) repair(groupId string) (group Group, ok bool) {
+	group, ok = groupMap.v[groupId]
+	if ok && group.missingSets() {
+		if group.Users == nil {
+			group.Users = strset.NewAtomicStringSet()
+		}
+		if group.Mods == nil {
+			group.Mods = strset.NewAtomicStringSet()
+		}
+		if group.Away == nil {
+			group.Away = strset.NewAtomicStringSet()
+		}
+		groupMap.v[groupId] = group
 	}
+	return
+}
+
+// Returns the owner of the given group, and a boolean if that group exists
+func (groupMap *GroupMap) Owner(groupId string) (owner string, ok bool) {
+	groupMap.lock.RLock()
+	group, ok := groupMap.v[groupId]
 	groupMap.lock.RUnlock()
-	if ok {
-		groupMap.lock.Lock() //RW lock
-		groupMap.v[group].Users.Add(user)
-		groupMap.lock.Unlock()
+	return group.Owner, ok
+}
+
+// Adds a user to the given group. Returns whether they were added, were already in it, or the
+// group doesn't exist
+func (groupMap *GroupMap) AddUser(group, user string) AddResult {
+	// Check and add under one lock so the group can't be deleted in between
+	groupMap.lock.Lock()
+	defer groupMap.lock.Unlock()
+	g, ok := groupMap.repair(group)
+	if !ok {
+		return NoSuchGroup
 	}
-	return
+	if !g.Users.Add(user) {
+		return AlreadyMember
+	}
+	indexAdd(groupMap.userGroups, user, group)
+	return Added
 }
 
-// Removes the user from the given group. Returns false if the group doesn't exist
+// Removes the user from the given group, along with any moderator status they had in it.
+// Returns false if the group doesn't exist
 func (groupMap *GroupMap) RemoveUser(group, user string) (ok bool) {
+	groupMap.lock.Lock()
+	if g, exists := groupMap.repair(group); exists && g.Users.Remove(user) {
+		g.Mods.Remove(user)
+		g.Away.Remove(user)
+		indexRemove(groupMap.userGroups, user, group)
+		ok = true
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Moves the user from one group to another under a single lock, so they're never in both or
+// neither. Moderator status in the first group is dropped. Returns an error without moving them
+// if either group doesn't exist, they aren't in the first group, or are already in the second
+func (groupMap *GroupMap) MoveUser(from, to, user string) (ok bool, err error) {
+	groupMap.lock.Lock()
+	defer groupMap.lock.Unlock()
+	fromGroup, ok := groupMap.repair(from)
+	if !ok {
+		return false, errors.New(fmt.Sprintf("Group %s doesn't exist.", from))
+	}
+	toGroup, ok := groupMap.repair(to)
+	if !ok {
+		return false, errors.New(fmt.Sprintf("Group %s doesn't exist.", to))
+	}
+	if !fromGroup.Users.Contains(user) {
+		return false, errors.New(fmt.Sprintf("You aren't in the group %s.", from))
+	}
+	if toGroup.Users.Contains(user) {
+		return false, errors.New(fmt.Sprintf("You're already in the group %s.", to))
+	}
+	fromGroup.Users.Remove(user)
+	fromGroup.Mods.Remove(user)
+	fromGroup.Away.Remove(user)
+	indexRemove(groupMap.userGroups, user, from)
+	toGroup.Users.Add(user)
+	indexAdd(groupMap.userGroups, user, to)
+	return true, nil
+}
+
+// Removes the user from every group they're in under a single lock, along with any moderator
+// status they had. Returns the names of the groups they were removed from
+func (groupMap *GroupMap) RemoveUserFromAll(user string) (groupNames []string) {
+	groupMap.lock.Lock()
+	if index, ok := groupMap.userGroups[user]; ok {
+		groupNames = index.Array()
+		for _, group := range groupNames {
+			if g, ok := groupMap.repair(group); ok {
+				g.Users.Remove(user)
+				g.Mods.Remove(user)
+				g.Away.Remove(user)
+			}
+		}
+		delete(groupMap.userGroups, user)
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Makes the user a moderator of the given group.
+// Returns false if the group doesn't exist, the user isn't in it, or is already a moderator
+func (groupMap *GroupMap) AddModerator(group, user string) (ok bool) {
+	groupMap.lock.Lock()
+	if g, exists := groupMap.repair(group); exists {
+		ok = g.Users.Contains(user) && g.Mods.Add(user)
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Marks the user as away from the given group, so they aren't sent its messages, or as back.
+// Returns false if the group doesn't exist, the user isn't in it, or is already away or back
+func (groupMap *GroupMap) SetAway(group, user string, away bool) (ok bool) {
+	groupMap.lock.Lock()
+	if g, exists := groupMap.repair(group); exists && g.Users.Contains(user) {
+		if away {
+			ok = g.Away.Add(user)
+		} else {
+			ok = g.Away.Remove(user)
+		}
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Returns if the user is away from the given group. Returns false if the group doesn't exist
+func (groupMap *GroupMap) IsAway(group, user string) (away bool) {
 	groupMap.lock.RLock()
-	if _, ok = groupMap.v[group]; ok {
-		ok = groupMap.v[group].Users.Contains(user)
+	if g, exists := groupMap.v[group]; exists {
+		away = g.Away != nil && g.Away.Contains(user)
 	}
 	groupMap.lock.RUnlock()
-	if ok {
-		groupMap.lock.Lock()
-		groupMap.v[group].Users.Remove(user)
-		groupMap.lock.Unlock()
+	return
+}
+
+// Returns if the user is a moderator of the given group. Returns false if the group doesn't exist
+func (groupMap *GroupMap) IsModerator(group, user string) (ok bool) {
+	groupMap.lock.RLock()
+	if g, exists := groupMap.v[group]; exists {
+		ok = g.Mods != nil && g.Mods.Contains(user)
+	}
+	groupMap.lock.RUnlock()
+	return
+}
+
+// Returns how many users are in the given group, and a boolean if that group exists
+func (groupMap *GroupMap) Size(group string) (size int, ok bool) {
+	groupMap.lock.RLock()
+	var g Group
+	if g, ok = groupMap.v[group]; ok && g.Users != nil {
+		size = g.Users.Size()
 	}
+	groupMap.lock.RUnlock()
 	return
 }
 
@@ -169,8 +641,9 @@ func (groupMap *GroupMap) RemoveUser(group, user string) (ok bool) {
 // Second boolean is if the group exists.
 func (groupMap *GroupMap) ContainsUser(group, user string) (contains, ok bool) {
 	groupMap.lock.RLock()
-	if _, ok = groupMap.v[group]; ok {
-		contains = groupMap.v[group].Users.Contains(user)
+	var g Group
+	if g, ok = groupMap.v[group]; ok && g.Users != nil {
+		contains = g.Users.Contains(user)
 	}
 	groupMap.lock.RUnlock()
 	return
@@ -178,38 +651,320 @@ func (groupMap *GroupMap) ContainsUser(group, user string) (contains, ok bool) {
 
 // Creates a group with the given name and owner. Returns false if group exists.
 func (groupMap *GroupMap) Create(group, owner string) (ok bool) {
+	// Check and create under the same lock, so two creates of the same group can't both succeed
+	groupMap.lock.Lock()
+	_, exists := groupMap.v[group]
+	if !exists {
+		groupMap.v[group] = NewGroup(owner)
+		indexAdd(groupMap.ownedGroups, owner, group)
+	}
+	groupMap.lock.Unlock()
+	return !exists
+}
+
+// Pins the message in the given group, replacing any already pinned. An empty message unpins
+// it. Returns false if the group doesn't exist
+func (groupMap *GroupMap) SetPin(groupId, pinned string) (ok bool) {
+	groupMap.lock.Lock()
+	group, ok := groupMap.v[groupId]
+	if ok {
+		group.Pinned = pinned
+		groupMap.v[groupId] = group
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Returns the message pinned in the given group, and a boolean if that group exists
+func (groupMap *GroupMap) Pin(groupId string) (pinned string, ok bool) {
+	groupMap.lock.RLock()
+	group, ok := groupMap.v[groupId]
+	groupMap.lock.RUnlock()
+	return group.Pinned, ok
+}
+
+// Sets how long each member of the given group must wait between messages, 0 for no limit.
+// Returns false if the group doesn't exist
+func (groupMap *GroupMap) SetSlowMode(groupId string, interval time.Duration) (ok bool) {
+	groupMap.lock.Lock()
+	group, ok := groupMap.v[groupId]
+	if ok {
+		group.SlowMode = interval
+		groupMap.v[groupId] = group
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Sets whether the given group is frozen, so only its owner can send messages to it. Returns
+// false if the group doesn't exist
+func (groupMap *GroupMap) SetFrozen(groupId string, frozen bool) (ok bool) {
+	groupMap.lock.Lock()
+	group, ok := groupMap.v[groupId]
+	if ok {
+		group.Frozen = frozen
+		groupMap.v[groupId] = group
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Returns if the given group is frozen, and a boolean if that group exists
+func (groupMap *GroupMap) IsFrozen(groupId string) (frozen bool, ok bool) {
 	groupMap.lock.RLock()
-	_, ok = groupMap.v[group]
+	group, ok := groupMap.v[groupId]
 	groupMap.lock.RUnlock()
+	return group.Frozen, ok
+}
+
+// Sets the most members the given group may have, 0 for no limit. Members already in the group
+// aren't removed if it's over the limit. Returns false if the group doesn't exist
+func (groupMap *GroupMap) SetLimit(groupId string, limit int) (ok bool) {
+	groupMap.lock.Lock()
+	group, ok := groupMap.v[groupId]
+	if ok {
+		group.Limit = limit
+		groupMap.v[groupId] = group
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Returns the most members the given group may have, 0 if unlimited, and a boolean if that
+// group exists
+func (groupMap *GroupMap) Limit(groupId string) (limit int, ok bool) {
+	groupMap.lock.RLock()
+	group, ok := groupMap.v[groupId]
+	groupMap.lock.RUnlock()
+	return group.Limit, ok
+}
+
+// Returns the group with the given name, first creating it with the given owner if it doesn't
+// exist. Returns true if the group was created
+func (groupMap *GroupMap) GetOrCreate(groupId, owner string) (group Group, created bool) {
+	groupMap.lock.Lock()
+	group, ok := groupMap.repair(groupId)
 	if !ok {
-		groupMap.lock.Lock()
-		groupMap.v[group] = Group{owner, strset.NewAtomicStringSet()}
-		//groupMap.v[group].Users.Add(owner)
-		groupMap.lock.Unlock()
+		group = NewGroup(owner)
+		groupMap.v[groupId] = group
+		indexAdd(groupMap.ownedGroups, owner, groupId)
 	}
-	return !ok
+	groupMap.lock.Unlock()
+	return group, !ok
 }
 
 // Removes the given group from the GroupMap
 // Returns false if group doesn't exist
 func (groupMap *GroupMap) Delete(group string) (ok bool) {
+	groupMap.lock.Lock()
+	deleted, ok := groupMap.repair(group)
+	if ok {
+		for _, user := range deleted.Users.Array() {
+			indexRemove(groupMap.userGroups, user, group)
+		}
+		indexRemove(groupMap.ownedGroups, deleted.Owner, group)
+		delete(groupMap.v, group)
+	}
+	groupMap.lock.Unlock()
+	return
+}
+
+// Returns the names of the groups the user is in, using the reverse index so it's only
+// O(user's groups) rather than checking every group
+func (groupMap *GroupMap) UserGroups(user string) (groupNames []string) {
+	groupMap.lock.RLock()
+	if index, ok := groupMap.userGroups[user]; ok {
+		groupNames = index.Array()
+	}
+	groupMap.lock.RUnlock()
+	return
+}
+
+// Returns the names of the groups owned by the given user, using the reverse index of owners
+func (groupMap *GroupMap) OwnedBy(owner string) (groupNames []string) {
 	groupMap.lock.RLock()
-	_, ok = groupMap.v[group]
+	if index, ok := groupMap.ownedGroups[owner]; ok {
+		groupNames = index.Array()
+	}
 	groupMap.lock.RUnlock()
+	return
+}
+
+// Returns how many groups the given user owns
+func (groupMap *GroupMap) OwnedCount(owner string) (count int) {
+	groupMap.lock.RLock()
+	if index, ok := groupMap.ownedGroups[owner]; ok {
+		count = index.Size()
+	}
+	groupMap.lock.RUnlock()
+	return
+}
+
+// Records the group under the user in the reverse index, such as userGroups or ownedGroups.
+// The write lock must be held
+func indexAdd(index map[string]*strset.StringSet, user, group string) {
+	groupNames, ok := index[user]
+	if !ok {
+		groupNames = strset.NewStringSet()
+		index[user] = groupNames
+	}
+	groupNames.Add(group)
+}
+
+// Removes the group from the user's entry in the reverse index, dropping the entry once it's
+// empty. The write lock must be held
+func indexRemove(index map[string]*strset.StringSet, user, group string) {
+	if groupNames, ok := index[user]; ok {
+		groupNames.Remove(group)
+		if groupNames.Size() == 0 {
+			delete(index, user)
+		}
+	}
+}
+
+// Moves the given group to a new name, keeping its owner and users.
+// Returns false if the group doesn't exist or a group with the new name already exists.
+func (groupMap *GroupMap) Rename(oldName, newName string) (ok bool) {
+	groupMap.lock.Lock()
+	group, ok := groupMap.repair(oldName)
 	if ok {
-		groupMap.lock.Lock()
-		delete(groupMap.v, group)
-		groupMap.lock.Unlock()
+		if _, exists := groupMap.v[newName]; !exists {
+			groupMap.v[newName] = group
+			delete(groupMap.v, oldName)
+			for _, user := range group.Users.Array() {
+				indexRemove(groupMap.userGroups, user, oldName)
+				indexAdd(groupMap.userGroups, user, newName)
+			}
+			indexRemove(groupMap.ownedGroups, group.Owner, oldName)
+			indexAdd(groupMap.ownedGroups, group.Owner, newName)
+		} else {
+			ok = false
+		}
 	}
+	groupMap.lock.Unlock()
 	return
 }
 
-// Converts the keys of the map into a string slice.
+// Converts the keys of the map into a string slice, sorted so they're listed in the same
+// order every time
 func (groupMap *GroupMap) GroupNames() (groupNames []string) {
 	groupMap.lock.RLock()
 	for groupName, _ := range groupMap.v {
 		groupNames = append(groupNames, groupName)
 	}
 	groupMap.lock.RUnlock()
+	sort.Strings(groupNames)
+	return
+}
+
+// Returns the name, owner, and member count of each group, sorted by name. This only takes the
+// read lock once rather than getting each group separately
+func (groupMap *GroupMap) GroupInfos() (infos []GroupInfo) {
+	groupMap.lock.RLock()
+	infos = make([]GroupInfo, 0, len(groupMap.v))
+	for groupName, group := range groupMap.v {
+		members := 0
+		if group.Users != nil {
+			members = group.Users.Size()
+		}
+		infos = append(infos, GroupInfo{groupName, group.Owner, members})
+	}
+	groupMap.lock.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return
+}
+
+// Removes every group from the map
+func (groupMap *GroupMap) Clear() {
+	groupMap.lock.Lock()
+	groupMap.v = make(map[string]Group)
+	groupMap.userGroups = make(map[string]*strset.StringSet)
+	groupMap.ownedGroups = make(map[string]*strset.StringSet)
+	groupMap.lock.Unlock()
+}
+
+// Returns how many groups are in the map
+func (groupMap *GroupMap) Count() (count int) {
+	groupMap.lock.RLock()
+	count = len(groupMap.v)
+	groupMap.lock.RUnlock()
 	return
-}
\ No newline at end of file
+}
+
+// Returns a copy of every group, sorted by name. The read lock is held throughout so the copy
+// is consistent, with no group changed partway through
+func (groupMap *GroupMap) Export() (groups []GroupState) {
+	groupMap.lock.RLock()
+	groups = make([]GroupState, 0, len(groupMap.v))
+	for groupName, group := range groupMap.v {
+		state := GroupState{Name: groupName, Owner: group.Owner, Users: []string{}, SlowMode: group.SlowMode,
+			Pinned: group.Pinned, Frozen: group.Frozen, Limit: group.Limit}
+		if group.Users != nil {
+			state.Users = group.Users.SortedArray()
+		}
+		if group.Mods != nil {
+			state.Mods = group.Mods.SortedArray()
+		}
+		if group.Away != nil {
+			state.Away = group.Away.SortedArray()
+		}
+		groups = append(groups, state)
+	}
+	groupMap.lock.RUnlock()
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return
+}
+
+// Replaces every group with the given ones, such as from Export, rebuilding the reverse indexes
+func (groupMap *GroupMap) Import(groups []GroupState) {
+	groupMap.lock.Lock()
+	groupMap.v = make(map[string]Group)
+	groupMap.userGroups = make(map[string]*strset.StringSet)
+	groupMap.ownedGroups = make(map[string]*strset.StringSet)
+	for _, state := range groups {
+		group := NewGroup(state.Owner)
+		group.Users.AddAll(state.Users)
+		group.Mods.AddAll(state.Mods)
+		group.Away.AddAll(state.Away)
+		group.SlowMode = state.SlowMode
+		group.Pinned = state.Pinned
+		group.Frozen = state.Frozen
+		group.Limit = state.Limit
+		groupMap.v[state.Name] = group
+		for _, user := range state.Users {
+			indexAdd(groupMap.userGroups, user, state.Name)
+		}
+		indexAdd(groupMap.ownedGroups, state.Owner, state.Name)
+	}
+	groupMap.lock.Unlock()
+}
+
+// Constructor function for PipeDialer
+func NewPipeDialer() *PipeDialer {
+	return &PipeDialer{handlers: make(map[string]func(net.Conn))}
+}
+
+// Registers the handler to serve connections dialed to the given address
+func (dialer *PipeDialer) Handle(addr string, handler func(net.Conn)) {
+	dialer.lock.Lock()
+	dialer.handlers[addr] = handler
+	dialer.lock.Unlock()
+}
+
+// Returns one end of a net.Pipe, with the other end passed to the handler for the address.
+// Returns an error if no handler is registered for the address
+func (dialer *PipeDialer) Dial(network, addr string) (conn net.Conn, err error) {
+	dialer.lock.RLock()
+	handler, ok := dialer.handlers[addr]
+	dialer.lock.RUnlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New(fmt.Sprintf("no handler for %s", addr))}
+	}
+	conn, remote := net.Pipe()
+	go handler(remote)
+	return
+}
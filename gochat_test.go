@@ -0,0 +1,231 @@
+package gochat
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPipeDialer(t *testing.T) {
+	dialer := NewPipeDialer()
+	received := make(chan *Msg, 1)
+	dialer.Handle("server", func(conn net.Conn) {
+		defer conn.Close()
+		msg := &Msg{}
+		if err := msg.Retrieve(conn); err != nil {
+			t.Errorf("Retrieve: %s", err)
+		}
+		received <- msg
+	})
+
+	sent := &Msg{User: "ryan", To: "team", Msg: "hello", Cmd: "group", Payload: []byte("data"), Filename: "a.txt"}
+	if err := sent.SendWith(dialer, "server"); err != nil {
+		t.Fatalf("SendWith: %s", err)
+	}
+	select {
+	case msg := <-received:
+		if msg.User != sent.User || msg.To != sent.To || msg.Msg != sent.Msg || msg.Cmd != sent.Cmd ||
+			!bytes.Equal(msg.Payload, sent.Payload) || msg.Filename != sent.Filename {
+			t.Errorf("Received %+v, want %+v", msg, sent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler never received the message")
+	}
+
+	if err := sent.SendWith(dialer, "nobody"); err == nil {
+		t.Error("SendWith to an address without a handler didn't return an error")
+	} else if opErr, ok := err.(*net.OpError); !ok || opErr.Op != "dial" {
+		t.Errorf("SendWith to an address without a handler returned %v, want a dial error", err)
+	}
+
+	tooLarge := &Msg{Payload: make([]byte, MaxPayloadSize+1)}
+	if err := tooLarge.SendWith(dialer, "server"); err != ErrTooLarge {
+		t.Errorf("SendWith of an oversized payload returned %v, want ErrTooLarge", err)
+	}
+}
+
+func TestGroupMapIndexes(t *testing.T) {
+	groupMap := NewGroupMap()
+	check := func(step string, userGroups map[string][]string, owned map[string][]string) {
+		for user, want := range userGroups {
+			got := groupMap.UserGroups(user)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: UserGroups(%s) = %v, want %v", step, user, got, want)
+			}
+		}
+		for owner, want := range owned {
+			got := groupMap.OwnedBy(owner)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: OwnedBy(%s) = %v, want %v", step, owner, got, want)
+			}
+			if count := groupMap.OwnedCount(owner); count != len(want) {
+				t.Errorf("%s: OwnedCount(%s) = %d, want %d", step, owner, count, len(want))
+			}
+		}
+	}
+	steps := []struct {
+		name string
+		do func() bool
+		userGroups map[string][]string
+		owned map[string][]string
+	}{
+		{"create", func() bool { return groupMap.Create("a", "ryan") && groupMap.Create("b", "ryan") },
+			map[string][]string{"ryan": nil}, map[string][]string{"ryan": {"a", "b"}}},
+		{"create existing", func() bool { return !groupMap.Create("a", "mike") },
+			nil, map[string][]string{"ryan": {"a", "b"}, "mike": nil}},
+		{"add users", func() bool {
+			return groupMap.AddUser("a", "ryan") == Added && groupMap.AddUser("a", "mike") == Added &&
+				groupMap.AddUser("b", "mike") == Added && groupMap.AddUser("a", "mike") == AlreadyMember &&
+				groupMap.AddUser("c", "mike") == NoSuchGroup
+		}, map[string][]string{"ryan": {"a"}, "mike": {"a", "b"}}, nil},
+		{"remove user", func() bool { return groupMap.RemoveUser("b", "mike") && !groupMap.RemoveUser("b", "mike") },
+			map[string][]string{"mike": {"a"}}, nil},
+		{"move user", func() bool {
+			ok, err := groupMap.MoveUser("a", "b", "mike")
+			return ok && err == nil
+		}, map[string][]string{"mike": {"b"}, "ryan": {"a"}}, nil},
+		{"move user not in group", func() bool {
+			_, err := groupMap.MoveUser("a", "b", "mike")
+			return err != nil
+		}, map[string][]string{"mike": {"b"}}, nil},
+		{"rename", func() bool { return groupMap.Rename("b", "c") && !groupMap.Rename("a", "c") },
+			map[string][]string{"mike": {"c"}, "ryan": {"a"}}, map[string][]string{"ryan": {"a", "c"}}},
+		{"remove from all", func() bool {
+			return groupMap.AddUser("a", "mike") == Added &&
+				reflect.DeepEqual(sortedNames(groupMap.RemoveUserFromAll("mike")), []string{"a", "c"})
+		}, map[string][]string{"mike": nil, "ryan": {"a"}}, nil},
+		{"delete", func() bool { return groupMap.Delete("a") && !groupMap.Delete("a") },
+			map[string][]string{"ryan": nil}, map[string][]string{"ryan": {"c"}}},
+		{"import", func() bool {
+			groupMap.Import([]GroupState{
+				{Name: "x", Owner: "mike", Users: []string{"mike", "ryan"}},
+				{Name: "y", Owner: "mike", Users: []string{"ryan"}},
+			})
+			return groupMap.Count() == 2
+		}, map[string][]string{"ryan": {"x", "y"}, "mike": {"x"}}, map[string][]string{"ryan": nil, "mike": {"x", "y"}}},
+		{"clear", func() bool { groupMap.Clear(); return groupMap.Count() == 0 },
+			map[string][]string{"ryan": nil, "mike": nil}, map[string][]string{"mike": nil}},
+	}
+	for _, step := range steps {
+		if !step.do() {
+			t.Errorf("%s: unexpected result", step.name)
+		}
+		check(step.name, step.userGroups, step.owned)
+	}
+}
+
+func sortedNames(names []string) []string {
+	sort.Strings(names)
+	return names
+}
+
+func TestSendUnreachable(t *testing.T) {
+	// Find a port nothing is listening on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	msg := &Msg{User: "ryan", Cmd: "init"}
+	if err := msg.Send(addr); err == nil {
+		t.Errorf("Send to %s, which nothing is listening on, didn't return an error", addr)
+	}
+}
+
+func TestAddrMapDevices(t *testing.T) {
+	phone, laptop, tablet := Addr{"10.0.0.1", "1"}, Addr{"10.0.0.2", "2"}, Addr{"10.0.0.3", "3"}
+	addrMap := NewAddrMap()
+	adds := []struct {
+		addr Addr
+		first bool
+	}{
+		{phone, true},
+		{laptop, false},
+		{phone, false}, // already connected there, so it isn't added twice
+		{tablet, false},
+	}
+	for _, add := range adds {
+		if first := addrMap.Add("ryan", add.addr); first != add.first {
+			t.Errorf("Add(%v) = %v, want %v", add.addr, first, add.first)
+		}
+	}
+	if all := addrMap.All("ryan"); !reflect.DeepEqual(all, []Addr{phone, laptop, tablet}) {
+		t.Errorf("All = %v, want each device once, oldest first", all)
+	}
+	if addr, ok := addrMap.Get("ryan"); !ok || addr != tablet {
+		t.Errorf("Get = %v, %v, want the newest device %v", addr, ok, tablet)
+	}
+
+	removes := []struct {
+		addr Addr
+		ok, last bool
+		left []Addr
+	}{
+		{Addr{"10.0.0.9", "9"}, false, false, []Addr{phone, laptop, tablet}},
+		{laptop, true, false, []Addr{phone, tablet}},
+		{laptop, false, false, []Addr{phone, tablet}},
+		{tablet, true, false, []Addr{phone}},
+		{phone, true, true, nil},
+		{phone, false, false, nil},
+	}
+	for _, remove := range removes {
+		ok, last := addrMap.RemoveAddr("ryan", remove.addr)
+		if ok != remove.ok || last != remove.last {
+			t.Errorf("RemoveAddr(%v) = %v, %v, want %v, %v", remove.addr, ok, last, remove.ok, remove.last)
+		}
+		if all := addrMap.All("ryan"); !reflect.DeepEqual(all, remove.left) {
+			t.Errorf("After RemoveAddr(%v) All = %v, want %v", remove.addr, all, remove.left)
+		}
+	}
+	if addrMap.Online("ryan") {
+		t.Error("User is still online after their last device was removed")
+	}
+}
+
+func TestAddUserResult(t *testing.T) {
+	groupMap := NewGroupMap()
+	groupMap.Create("team", "ryan")
+	tests := []struct {
+		group, user string
+		want AddResult
+	}{
+		{"team", "mike", Added},
+		{"team", "mike", AlreadyMember},
+		{"band", "mike", NoSuchGroup},
+		{"team", "tony", Added},
+	}
+	for _, test := range tests {
+		if got := groupMap.AddUser(test.group, test.user); got != test.want {
+			t.Errorf("AddUser(%s, %s) = %d, want %d", test.group, test.user, got, test.want)
+		}
+	}
+	if groups := groupMap.UserGroups("mike"); !reflect.DeepEqual(groups, []string{"team"}) {
+		t.Errorf("mike is in %v, want only team", groups)
+	}
+}
+
+func TestGroupMapMissingSets(t *testing.T) {
+	if group := NewGroup("ryan"); group.Owner != "ryan" || group.missingSets() {
+		t.Errorf("NewGroup returned %+v, want a group owned by ryan with all its sets", group)
+	}
+	groupMap := NewGroupMap()
+	groupMap.v["team"] = Group{Owner: "ryan"}
+	if contains, ok := groupMap.ContainsUser("team", "mike"); contains || !ok {
+		t.Errorf("ContainsUser = %v, %v, want false, true", contains, ok)
+	}
+	if result := groupMap.AddUser("team", "mike"); result != Added {
+		t.Errorf("AddUser = %v, want Added", result)
+	}
+	if !groupMap.AddModerator("team", "mike") || !groupMap.IsModerator("team", "mike") {
+		t.Error("Couldn't make mike a moderator of a group without a Mods set")
+	}
+	if group, ok := groupMap.Get("team"); !ok || group.missingSets() {
+		t.Errorf("Get returned %+v, want a group with all its sets", group)
+	}
+}
@@ -0,0 +1,55 @@
+package gochat
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"time"
+)
+
+// How many random bytes make up a signed message's Nonce
+const nonceSize = 16
+
+// Signs the message with an HMAC-SHA256 of its fields keyed by the secret, such as the session
+// token the server issued the sender, so the server can check it was sent by who it claims.
+// The message is stamped with when it was signed and a random Nonce first, so the receiver can
+// reject it if it's old or has been seen before. Only the Signature field isn't signed
+func (msg *Msg) Sign(secret []byte) {
+	msg.SignedAt = time.Now().UnixNano()
+	msg.Nonce = make([]byte, nonceSize)
+	// crypto/rand's Read never returns an error
+	rand.Read(msg.Nonce)
+	msg.Signature = msg.mac(secret)
+}
+
+// Checks the message's Signature was made by Sign with the same secret
+func (msg *Msg) Verify(secret []byte) bool {
+	if len(msg.Signature) == 0 {
+		return false
+	}
+	return hmac.Equal(msg.Signature, msg.mac(secret))
+}
+
+// Returns the HMAC of the message's signed fields. Each is prefixed with its length so the
+// boundaries between them can't be shifted without changing the HMAC
+func (msg *Msg) mac(secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	var signedAt [8]byte
+	binary.BigEndian.PutUint64(signedAt[:], uint64(msg.SignedAt))
+	for _, field := range [][]byte{[]byte(msg.User), []byte(msg.To), []byte(msg.Msg),
+		[]byte(msg.Cmd), []byte(msg.ID), []byte(msg.Token), msg.Payload, []byte(msg.Filename),
+		msg.Sealed, msg.Key, []byte(msg.ReplyTo), signedAt[:], msg.Nonce} {
+		writeField(h, field)
+	}
+	return h.Sum(nil)
+}
+
+// Writes the field to the hash prefixed by its length
+func writeField(h hash.Hash, field []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+	h.Write(length[:])
+	h.Write(field)
+}
@@ -0,0 +1,60 @@
+package gochat
+
+import (
+	"bytes"
+	"testing"
+)
+
+func signedMsg(secret string) *Msg {
+	msg := &Msg{User: "ryan", To: "team", Msg: "hello", Cmd: "group", ID: "1", Token: "token",
+		Payload: []byte("data"), Filename: "a.txt", ReplyTo: "0"}
+	msg.Sign([]byte(secret))
+	return msg
+}
+
+func TestSignVerify(t *testing.T) {
+	msg := signedMsg("secret")
+	if !msg.Verify([]byte("secret")) {
+		t.Fatal("Verify rejected a message signed with the same secret")
+	}
+	if msg.SignedAt == 0 || len(msg.Nonce) != nonceSize {
+		t.Errorf("Sign set SignedAt %d and a %d byte Nonce", msg.SignedAt, len(msg.Nonce))
+	}
+	if other := signedMsg("secret"); bytes.Equal(msg.Nonce, other.Nonce) || bytes.Equal(msg.Signature, other.Signature) {
+		t.Error("Signing the same message twice gave the same Nonce or Signature")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		secret string
+		change func(msg *Msg)
+	}{
+		{"wrong secret", "other", func(msg *Msg) {}},
+		{"unsigned", "secret", func(msg *Msg) { msg.Signature = nil }},
+		{"User", "secret", func(msg *Msg) { msg.User = "eve" }},
+		{"To", "secret", func(msg *Msg) { msg.To = "other" }},
+		{"Msg", "secret", func(msg *Msg) { msg.Msg = "goodbye" }},
+		{"Cmd", "secret", func(msg *Msg) { msg.Cmd = "delete" }},
+		{"ID", "secret", func(msg *Msg) { msg.ID = "2" }},
+		{"Token", "secret", func(msg *Msg) { msg.Token = "stolen" }},
+		{"Payload", "secret", func(msg *Msg) { msg.Payload = []byte("evil") }},
+		{"Filename", "secret", func(msg *Msg) { msg.Filename = "b.txt" }},
+		{"Sealed", "secret", func(msg *Msg) { msg.Sealed = []byte("x") }},
+		{"Key", "secret", func(msg *Msg) { msg.Key = []byte("x") }},
+		{"ReplyTo", "secret", func(msg *Msg) { msg.ReplyTo = "3" }},
+		{"SignedAt", "secret", func(msg *Msg) { msg.SignedAt++ }},
+		{"Nonce", "secret", func(msg *Msg) { msg.Nonce[0]++ }},
+		{"Signature", "secret", func(msg *Msg) { msg.Signature[0]++ }},
+		// Moving bytes between fields must change the HMAC too
+		{"field boundary", "secret", func(msg *Msg) { msg.User, msg.To = "ryant", "eam" }},
+	}
+	for _, test := range tests {
+		msg := signedMsg("secret")
+		test.change(msg)
+		if msg.Verify([]byte(test.secret)) {
+			t.Errorf("%s: Verify accepted the changed message", test.name)
+		}
+	}
+}
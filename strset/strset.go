@@ -7,7 +7,10 @@ are not exported.
 */
 package strset
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 // We just care about the key's value, so have the value we're mapping to be something
 // simple, such as bool
@@ -26,6 +29,15 @@ func NewStringSet() *StringSet {
 	return &StringSet{set: make(map[string]bool)}
 }
 
+// Constructor for StringSet containing the given strings. Duplicates are only added once
+func NewStringSetFromSlice(items []string) *StringSet {
+	set := &StringSet{set: make(map[string]bool, len(items))}
+	for _, s := range items {
+		set.set[s] = true
+	}
+	return set
+}
+
 // Adds a new key to the map. Returns true if the value already existed
 func (set *StringSet) Add(s string) (found bool) {
 	_, found = set.set[s]
@@ -33,6 +45,20 @@ func (set *StringSet) Add(s string) (found bool) {
 	return !found
 }
 
+// Adds all of the strings as keys to the map
+func (set *StringSet) AddAll(items []string) {
+	for _, s := range items {
+		set.set[s] = true
+	}
+}
+
+// Deletes all of the strings from the map
+func (set *StringSet) RemoveAll(items []string) {
+	for _, s := range items {
+		delete(set.set, s)
+	}
+}
+
 // Returns a bool whether or not the string exists as a key in the map
 func (set *StringSet) Contains(s string) (found bool) {
 	_, found = set.set[s]
@@ -45,6 +71,11 @@ func (set *StringSet) Remove(s string) {
 	delete(set.set, s)
 }
 
+// Returns how many keys are in the map
+func (set *StringSet) Size() int {
+	return len(set.set)
+}
+
 // Converts the map's keys into a string slice
 func (set *StringSet) Array() (s []string) {
 	for k, _ := range set.set {
@@ -53,11 +84,63 @@ func (set *StringSet) Array() (s []string) {
 	return
 }
 
+// Returns the keys of the map sorted, so they're listed in the same order every time
+func (set *StringSet) SortedArray() (s []string) {
+	s = set.Array()
+	sort.Strings(s)
+	return
+}
+
+// Returns an arbitrary key from the map, or false if it's empty. Which key is returned is
+// unspecified, as Go's map iteration order is.
+func (set *StringSet) Any() (s string, found bool) {
+	for s, _ = range set.set {
+		return s, true
+	}
+	return
+}
+
+// Returns the first key the predicate is true for, or false if there isn't one. Keys are
+// checked in an unspecified order, as Go's map iteration order is.
+func (set *StringSet) Find(pred func(string) bool) (s string, found bool) {
+	for s, _ = range set.set {
+		if pred(s) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// Removes and returns an arbitrary key from the map, or false if it's empty. Which key is
+// removed is unspecified.
+func (set *StringSet) Pop() (s string, found bool) {
+	if s, found = set.Any(); found {
+		set.Remove(s)
+	}
+	return
+}
+
+// Returns a new set of the strings in this set that aren't in the other set
+func (set *StringSet) Difference(other *StringSet) *StringSet {
+	diff := NewStringSet()
+	for s := range set.set {
+		if !other.set[s] {
+			diff.set[s] = true
+		}
+	}
+	return diff
+}
+
 // Constructor fo AtomicStringSet
 func NewAtomicStringSet() *AtomicStringSet {
 	return &AtomicStringSet{set: NewStringSet()}
 }
 
+// Constructor for AtomicStringSet containing the given strings. Duplicates are only added once
+func NewAtomicStringSetFromSlice(items []string) *AtomicStringSet {
+	return &AtomicStringSet{set: NewStringSetFromSlice(items)}
+}
+
 func (set *AtomicStringSet) Add(s string) (found bool) {
 	set.lock.Lock()
 	found = set.set.Add(s)
@@ -65,6 +148,20 @@ func (set *AtomicStringSet) Add(s string) (found bool) {
 	return found
 }
 
+// Adds all of the strings while only taking the write lock once
+func (set *AtomicStringSet) AddAll(items []string) {
+	set.lock.Lock()
+	set.set.AddAll(items)
+	set.lock.Unlock()
+}
+
+// Removes all of the strings while only taking the write lock once
+func (set *AtomicStringSet) RemoveAll(items []string) {
+	set.lock.Lock()
+	set.set.RemoveAll(items)
+	set.lock.Unlock()
+}
+
 func (set *AtomicStringSet) Contains(s string) (found bool) {
 	set.lock.RLock()
 	found = set.set.Contains(s)
@@ -86,9 +183,79 @@ func (set *AtomicStringSet) Remove(s string) (found bool) {
 	return
 }
 
+func (set *AtomicStringSet) Size() (size int) {
+	set.lock.RLock()
+	size = set.set.Size()
+	set.lock.RUnlock()
+	return
+}
+
 func (set *AtomicStringSet) Array() (s []string) {
 	set.lock.RLock()
 	s = set.set.Array()
 	set.lock.RUnlock()
 	return
-}
\ No newline at end of file
+}
+
+// Returns the strings in the set sorted, so they're listed in the same order every time
+func (set *AtomicStringSet) SortedArray() (s []string) {
+	s = set.Array()
+	sort.Strings(s)
+	return
+}
+
+// Returns an arbitrary string from the set, or false if it's empty. Which string is returned is
+// unspecified.
+func (set *AtomicStringSet) Any() (s string, found bool) {
+	set.lock.RLock()
+	s, found = set.set.Any()
+	set.lock.RUnlock()
+	return
+}
+
+// Returns the first string the predicate is true for, or false if there isn't one, stopping as
+// soon as it's found. Strings are checked in an unspecified order.
+// NOTE: The predicate runs while the read lock is held, so it must not modify the set
+func (set *AtomicStringSet) Find(pred func(string) bool) (s string, found bool) {
+	set.lock.RLock()
+	s, found = set.set.Find(pred)
+	set.lock.RUnlock()
+	return
+}
+
+// Removes and returns an arbitrary string from the set, or false if it's empty. Which string is
+// removed is unspecified.
+func (set *AtomicStringSet) Pop() (s string, found bool) {
+	set.lock.Lock()
+	s, found = set.set.Pop()
+	set.lock.Unlock()
+	return
+}
+
+// Returns a new set of the strings in this set that aren't in the other set.
+// NOTE: The other set is copied under its read lock before this set is locked, so the two locks
+// are never held at once. Otherwise a.Difference(b) and b.Difference(a) could deadlock while
+// writers are waiting on both, such as when computing a symmetric difference concurrently
+func (set *AtomicStringSet) Difference(other *AtomicStringSet) *AtomicStringSet {
+	if set == other {
+		return NewAtomicStringSet()
+	}
+	other.lock.RLock()
+	otherCopy := NewStringSetFromSlice(other.set.Array())
+	other.lock.RUnlock()
+	set.lock.RLock()
+	diff := set.set.Difference(otherCopy)
+	set.lock.RUnlock()
+	return &AtomicStringSet{set: diff}
+}
+
+// Returns if any of the sets contain the string, stopping at the first that does. Each set is
+// only locked while it's being checked, and nil sets are skipped
+func ContainsAny(s string, sets ...*AtomicStringSet) bool {
+	for _, set := range sets {
+		if set != nil && set.Contains(s) {
+			return true
+		}
+	}
+	return false
+}
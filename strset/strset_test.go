@@ -0,0 +1,131 @@
+package strset
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func sorted(s []string) []string {
+	s = append([]string{}, s...)
+	sort.Strings(s)
+	return s
+}
+
+func TestPop(t *testing.T) {
+	items := []string{"a", "b", "c"}
+	set := NewStringSetFromSlice(items)
+	atomic := NewAtomicStringSetFromSlice(items)
+	var popped, atomicPopped []string
+	for i := 0; i < len(items); i++ {
+		s, found := set.Pop()
+		if !found {
+			t.Fatalf("StringSet.Pop found nothing with %d strings left", set.Size()+1)
+		}
+		popped = append(popped, s)
+		s, found = atomic.Pop()
+		if !found {
+			t.Fatalf("AtomicStringSet.Pop found nothing with %d strings left", atomic.Size()+1)
+		}
+		atomicPopped = append(atomicPopped, s)
+	}
+	if !reflect.DeepEqual(sorted(popped), items) {
+		t.Errorf("StringSet.Pop returned %v, want each of %v once", popped, items)
+	}
+	if !reflect.DeepEqual(sorted(atomicPopped), items) {
+		t.Errorf("AtomicStringSet.Pop returned %v, want each of %v once", atomicPopped, items)
+	}
+	if s, found := set.Pop(); found {
+		t.Errorf("StringSet.Pop on an empty set returned %q", s)
+	}
+	if s, found := atomic.Pop(); found {
+		t.Errorf("AtomicStringSet.Pop on an empty set returned %q", s)
+	}
+}
+
+func TestAddAllRemoveAll(t *testing.T) {
+	tests := []struct {
+		name string
+		start, add, remove []string
+		want []string
+	}{
+		{"empty", nil, nil, nil, []string{}},
+		{"add only", nil, []string{"a", "b"}, nil, []string{"a", "b"}},
+		{"duplicates added once", []string{"a"}, []string{"a", "b", "b"}, nil, []string{"a", "b"}},
+		{"remove some", []string{"a", "b", "c"}, nil, []string{"b"}, []string{"a", "c"}},
+		{"remove missing", []string{"a"}, nil, []string{"x", "y"}, []string{"a"}},
+		{"add then remove", nil, []string{"a", "b", "c"}, []string{"a", "c"}, []string{"b"}},
+	}
+	for _, test := range tests {
+		set := NewStringSetFromSlice(test.start)
+		set.AddAll(test.add)
+		set.RemoveAll(test.remove)
+		if got := set.SortedArray(); !reflect.DeepEqual(sorted(got), test.want) {
+			t.Errorf("%s: StringSet has %v, want %v", test.name, got, test.want)
+		}
+		atomic := NewAtomicStringSetFromSlice(test.start)
+		atomic.AddAll(test.add)
+		atomic.RemoveAll(test.remove)
+		if got := atomic.SortedArray(); !reflect.DeepEqual(sorted(got), test.want) {
+			t.Errorf("%s: AtomicStringSet has %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestContainsAny(t *testing.T) {
+	a := NewAtomicStringSetFromSlice([]string{"ryan"})
+	b := NewAtomicStringSetFromSlice([]string{"mike", "tony"})
+	tests := []struct {
+		s string
+		sets []*AtomicStringSet
+		want bool
+	}{
+		{"ryan", nil, false},
+		{"ryan", []*AtomicStringSet{a, b}, true},
+		{"tony", []*AtomicStringSet{a, b}, true},
+		{"tony", []*AtomicStringSet{a}, false},
+		{"eve", []*AtomicStringSet{a, b}, false},
+		{"mike", []*AtomicStringSet{nil, b}, true},
+		{"mike", []*AtomicStringSet{nil}, false},
+	}
+	for _, test := range tests {
+		if got := ContainsAny(test.s, test.sets...); got != test.want {
+			t.Errorf("ContainsAny(%q) over %d sets = %v, want %v", test.s, len(test.sets), got, test.want)
+		}
+	}
+}
+
+func TestDifference(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want []string
+	}{
+		{"both empty", nil, nil, []string{}},
+		{"other empty", []string{"a", "b"}, nil, []string{"a", "b"}},
+		{"disjoint", []string{"a"}, []string{"b"}, []string{"a"}},
+		{"overlap", []string{"a", "b", "c"}, []string{"b", "d"}, []string{"a", "c"}},
+		{"subset", []string{"a"}, []string{"a", "b"}, []string{}},
+		{"identical", []string{"a", "b"}, []string{"b", "a"}, []string{}},
+	}
+	for _, test := range tests {
+		a, b := NewStringSetFromSlice(test.a), NewStringSetFromSlice(test.b)
+		if got := a.Difference(b).SortedArray(); !reflect.DeepEqual(sorted(got), test.want) {
+			t.Errorf("%s: StringSet difference is %v, want %v", test.name, got, test.want)
+		}
+		atomicA, atomicB := NewAtomicStringSetFromSlice(test.a), NewAtomicStringSetFromSlice(test.b)
+		if got := atomicA.Difference(atomicB).SortedArray(); !reflect.DeepEqual(sorted(got), test.want) {
+			t.Errorf("%s: AtomicStringSet difference is %v, want %v", test.name, got, test.want)
+		}
+		// Neither set should be changed
+		if !reflect.DeepEqual(a.SortedArray(), NewStringSetFromSlice(test.a).SortedArray()) ||
+			!reflect.DeepEqual(atomicA.SortedArray(), NewStringSetFromSlice(test.a).SortedArray()) ||
+			!reflect.DeepEqual(atomicB.SortedArray(), NewStringSetFromSlice(test.b).SortedArray()) {
+			t.Errorf("%s: Difference changed a set to %v and %v", test.name, atomicA.SortedArray(), atomicB.SortedArray())
+		}
+	}
+	set := NewAtomicStringSetFromSlice([]string{"a", "b"})
+	if size := set.Difference(set).Size(); size != 0 {
+		t.Errorf("set.Difference(set) has %d strings, want 0", size)
+	}
+}
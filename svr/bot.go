@@ -0,0 +1,84 @@
+package svr
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"github.com/zembrodt/gochat"
+)
+
+// Answers a bot command sent to a group, returning the text of the reply, or "" to not reply
+// NOTE: Everything after the command's prefix will be in args
+type BotHandler func(msg gochat.Msg, args string) string
+
+// Name bot replies are sent as when the Server's BotName isn't set
+const defaultBotName = "bot"
+
+// Registers the handler to answer group messages starting with the prefix, such as "!roll".
+// Its replies are sent to the group as normal group messages from the Server's bot, which has
+// no connection of its own
+func (server *Server) HandleBot(prefix string, handler BotHandler) {
+	server.botLock.Lock()
+	server.bots[prefix] = handler
+	server.botLock.Unlock()
+}
+
+// Returns the name the Server's bot sends its replies as
+func (server *Server) botName() string {
+	if server.BotName == "" {
+		return defaultBotName
+	}
+	return server.BotName
+}
+
+// Returns if the name belongs to the Server's bot, which is only once a handler is registered,
+// so no user can connect with it and pass themselves off as the bot
+func (server *Server) isBot(user string) bool {
+	server.botLock.RLock()
+	defer server.botLock.RUnlock()
+	return len(server.bots) > 0 && user == server.botName()
+}
+
+// Runs the bot handler the group message is a command for, if any, and sends its reply to the
+// group as a reply to the message
+func (server *Server) runBots(msg *gochat.Msg) {
+	fields := strings.Fields(msg.Msg)
+	if len(fields) == 0 {
+		return
+	}
+	server.botLock.RLock()
+	handler, ok := server.bots[fields[0]]
+	server.botLock.RUnlock()
+	if !ok {
+		return
+	}
+	text := handler(*msg, strings.TrimSpace(strings.TrimPrefix(msg.Msg, fields[0])))
+	if text == "" {
+		return
+	}
+	reply := &gochat.Msg{User: server.botName(), To: msg.To, Msg: text, Cmd: "group", ReplyTo: msg.ID}
+	failed, err := server.postGroupMsg(reply)
+	if err != nil {
+		fmt.Println("Bot reply error:", err)
+		return
+	}
+	if failed > 0 {
+		fmt.Printf("Bot reply to %s failed to reach %d members.\n", msg.To, failed)
+	}
+	server.publish(reply)
+}
+
+// An example BotHandler that rolls a die, 6 sided unless the number of sides is given,
+// such as "!roll 20"
+func RollBot(msg gochat.Msg, args string) string {
+	sides := 6
+	if args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 2 {
+			return "Usage: !roll [sides], where sides is at least 2."
+		}
+		sides = n
+	}
+	return fmt.Sprintf("%s rolled %d (1-%d).", msg.User, rand.Intn(sides)+1, sides)
+}
@@ -0,0 +1,190 @@
+package svr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"github.com/zembrodt/gochat"
+)
+
+// Servers can federate with peer servers so their users can share groups. Groups with the same
+// name on federated servers are treated as one group: a group message is relayed to each peer
+// hosting users, which delivers it to its own members of that group. Each server tracks which
+// peer its remote users are connected to.
+// NOTE: Peers are identified by the address they report, so a peer is only trusted if its
+// address is in AllowedPeers and what it sends is signed with the PeerSecret servers share
+
+// Returns the address the Server's peers reach it at
+func (server *Server) peerAddress() string {
+	if server.PeerAddress != "" {
+		return server.PeerAddress
+	}
+	return server.address
+}
+
+// Federates the Server with the server at the given address, allowing it as a peer. Once the
+// peer has checked we're allowed, it replies with the users connected to it, at which point it's
+// added to Peers and sent our own. Both servers need the same PeerSecret
+func (server *Server) AddPeer(addr string) error {
+	if addr == server.peerAddress() {
+		return errors.New("Can't federate a server with itself.")
+	}
+	if server.PeerSecret == "" {
+		return errors.New("Can't federate without a PeerSecret shared with the peer.")
+	}
+	server.AllowedPeers.Add(addr)
+	// Our users aren't sent until the peer has proven it shares the PeerSecret
+	return server.sendPeer(addr, &gochat.Msg{User: server.peerAddress(), Cmd: "peer"})
+}
+
+// Sends the handshake for federating to the verified peer at the given address, listing this
+// Server's users so the peer knows where they're connected
+func (server *Server) sendPeerHandshake(addr string) error {
+	handshake := &gochat.Msg{User: server.peerAddress(), Msg: strings.Join(server.Addrs.Users(), " "), Cmd: "peer"}
+	return server.sendPeer(addr, handshake)
+}
+
+// Signs the message with the PeerSecret and sends it to the peer at the given address
+func (server *Server) sendPeer(addr string, msg *gochat.Msg) error {
+	msg.Sign([]byte(server.PeerSecret))
+	return server.Transport.Send(addr, msg)
+}
+
+// Checks the message is from the given peer, which must be allowed, and was signed with the
+// PeerSecret recently enough and only sent once
+func (server *Server) verifyPeer(msg *gochat.Msg, peer string) error {
+	if server.PeerSecret == "" || !server.AllowedPeers.Contains(peer) {
+		return errors.New(fmt.Sprintf("Peer %s isn't allowed.", peer))
+	}
+	if !msg.Verify([]byte(server.PeerSecret)) || !server.fresh(msg) {
+		return errors.New(fmt.Sprintf("Message from peer %s has a missing, invalid, or replayed signature.", peer))
+	}
+	return nil
+}
+
+// Records a handshake from an allowed peer, replying with our own if it's a new peer
+// NOTE: The peer's address will be in msg.User and its users in msg.Msg
+func (server *Server) handlePeer(msg *gochat.Msg) error {
+	if err := server.verifyPeer(msg, msg.User); err != nil {
+		return err
+	}
+	isNew := server.Peers.Add(msg.User)
+	for _, user := range strings.Fields(msg.Msg) {
+		server.setLocation(user, msg.User)
+	}
+	if isNew {
+		return server.sendPeerHandshake(msg.User)
+	}
+	return nil
+}
+
+// Records a user connecting to or disconnecting from a peer
+// NOTE: The peer's address will be in msg.Token, whether the user is "online" or "offline" in
+// msg.To, and the user in msg.User
+func (server *Server) handlePeerUser(msg *gochat.Msg) error {
+	if !server.Peers.Contains(msg.Token) {
+		return errors.New(fmt.Sprintf("Location update from unknown peer %s.", msg.Token))
+	}
+	if err := server.verifyPeer(msg, msg.Token); err != nil {
+		return err
+	}
+	if msg.To == "online" {
+		server.setLocation(msg.User, msg.Token)
+	} else {
+		server.removeLocation(msg.User, msg.Token)
+	}
+	return nil
+}
+
+// Tells each peer a user connected to or disconnected from this Server, given "online" or
+// "offline"
+func (server *Server) announceUser(user, status string) {
+	for _, peer := range server.Peers.Array() {
+		// Each peer is sent its own copy, as signing gives each a different nonce
+		update := &gochat.Msg{User: user, To: status, Cmd: "peerUser", Token: server.peerAddress()}
+		if err := server.sendPeer(peer, update); err != nil {
+			fmt.Printf("Error updating peer %s: %s\n", peer, err)
+		}
+	}
+}
+
+// Returns the peer the user is connected to, and a boolean if they're connected to one
+func (server *Server) Locate(user string) (peer string, ok bool) {
+	server.locationLock.RLock()
+	peer, ok = server.locations[user]
+	server.locationLock.RUnlock()
+	return
+}
+
+// Records the user as connected to the given peer
+func (server *Server) setLocation(user, peer string) {
+	server.locationLock.Lock()
+	server.locations[user] = peer
+	server.locationLock.Unlock()
+}
+
+// Forgets the user's location, as long as they're still recorded at the given peer
+func (server *Server) removeLocation(user, peer string) {
+	server.locationLock.Lock()
+	if server.locations[user] == peer {
+		delete(server.locations, user)
+	}
+	server.locationLock.Unlock()
+}
+
+// Returns the peers hosting at least one user
+func (server *Server) hostingPeers() (peers []string) {
+	server.locationLock.RLock()
+	hosting := make(map[string]bool)
+	for _, peer := range server.locations {
+		hosting[peer] = true
+	}
+	server.locationLock.RUnlock()
+	for _, peer := range server.Peers.Array() {
+		if hosting[peer] {
+			peers = append(peers, peer)
+		}
+	}
+	return
+}
+
+// Relays a group message to each peer hosting users, sending any errors to the channel
+func (server *Server) federate(msg *gochat.Msg, c chan error) {
+	for _, peer := range server.hostingPeers() {
+		relay := &gochat.Msg{}
+		*relay = *msg
+		relay.Cmd = "federate"
+		relay.Token = server.peerAddress()
+		relay.ID = "" // IDs are only unique to a server, so the peer assigns its own
+		if err := server.sendPeer(peer, relay); err != nil {
+			c <- errors.New(fmt.Sprintf("Could not relay to peer %s: %s", peer, err))
+		}
+	}
+}
+
+// Delivers a group message relayed by a peer to this Server's members of the group
+// NOTE: The peer's address will be in msg.Token
+func (server *Server) handleFederate(msg *gochat.Msg, c chan error) {
+	if !server.Peers.Contains(msg.Token) {
+		c <- errors.New(fmt.Sprintf("Relayed message from unknown peer %s.", msg.Token))
+		close(c)
+		return
+	}
+	if err := server.verifyPeer(msg, msg.Token); err != nil {
+		c <- err
+		close(c)
+		return
+	}
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		// None of our users are in the group
+		close(c)
+		return
+	}
+	msg.Cmd = "group"
+	msg.Token = ""
+	// Track the message like any of our own so our members can ack it
+	msg.ID = server.NextID()
+	server.History.Add(*msg, group.Users.Array())
+	server.sendGroupLocal(msg, c)
+}
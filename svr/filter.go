@@ -0,0 +1,103 @@
+package svr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// How the Server cleans up the text of group and direct messages before sending them on
+type Normalization int
+
+const (
+	NormalizeNone Normalization = iota // messages are sent as is
+	NormalizeTrailing // trailing whitespace is trimmed, the default
+	NormalizeFull // surrounding whitespace is trimmed and control characters inside are escaped
+)
+
+// Sets the words masked out of group and direct messages. Matching is case-insensitive and
+// only on whole words. An empty list turns filtering off, which is the default
+func (server *Server) SetBannedWords(words []string) (err error) {
+	var quoted []string
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	var filter *regexp.Regexp
+	if len(quoted) > 0 {
+		filter, err = regexp.Compile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+		if err != nil {
+			return err
+		}
+	}
+	server.filterLock.Lock()
+	server.filter = filter
+	server.filterLock.Unlock()
+	return nil
+}
+
+// Sets the banned words from a list with one word per line, such as a file loaded at startup.
+// Blank lines and lines starting with # are skipped
+func (server *Server) LoadBannedWords(reader io.Reader) error {
+	var words []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return server.SetBannedWords(words)
+}
+
+// Replaces each banned word in the text with asterisks
+func (server *Server) filterWords(text string) string {
+	server.filterLock.RLock()
+	filter := server.filter
+	server.filterLock.RUnlock()
+	if filter == nil {
+		return text
+	}
+	return filter.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+}
+
+// Cleans up the text of a message as set by the Server's Normalization
+func (server *Server) normalize(text string) string {
+	switch server.Normalization {
+	case NormalizeTrailing:
+		return strings.TrimRightFunc(text, unicode.IsSpace)
+	case NormalizeFull:
+		return escapeControl(strings.TrimSpace(text))
+	}
+	return text
+}
+
+// Replaces each control character in the text, such as a newline, with its escaped form, so
+// it can't mangle the output of the terminal it's printed to
+func escapeControl(text string) string {
+	var escaped strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\n':
+			escaped.WriteString(`\n`)
+		case r == '\r':
+			escaped.WriteString(`\r`)
+		case r == '\t':
+			escaped.WriteString(`\t`)
+		case unicode.IsControl(r):
+			fmt.Fprintf(&escaped, `\x%02x`, r)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,94 @@
+package svr
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zembrodt/gochat"
+	"github.com/zembrodt/gochat/strset"
+)
+
+// Adds the friend to the user's friends. Returns false if they already were one
+func (server *Server) addFriend(user, friend string) bool {
+	server.friendLock.Lock()
+	defer server.friendLock.Unlock()
+	friends, ok := server.friends[user]
+	if !ok {
+		friends = strset.NewStringSet()
+		server.friends[user] = friends
+	}
+	return friends.Add(friend)
+}
+
+// Removes the friend from the user's friends. Returns false if they weren't one
+func (server *Server) removeFriend(user, friend string) bool {
+	server.friendLock.Lock()
+	defer server.friendLock.Unlock()
+	friends, ok := server.friends[user]
+	if !ok || !friends.Contains(friend) {
+		return false
+	}
+	friends.Remove(friend)
+	if friends.Size() == 0 {
+		delete(server.friends, user)
+	}
+	return true
+}
+
+// Returns if the user has added the friend as one of their friends
+func (server *Server) isFriend(user, friend string) bool {
+	server.friendLock.RLock()
+	defer server.friendLock.RUnlock()
+	friends, ok := server.friends[user]
+	return ok && friends.Contains(friend)
+}
+
+// Checks the target user (given by msg.To, allowing a unique prefix of their name) is online,
+// isn't the user, and for 'unfriend' is one of their friends. Returns the target user
+func (server *Server) validateFriend(msg *gochat.Msg) (target string, err error) {
+	if msg.Cmd == "unfriend" {
+		if !server.isFriend(msg.User, msg.To) {
+			return "", errors.New(fmt.Sprintf("User %s isn't one of your friends.", msg.To))
+		}
+		return msg.To, nil
+	}
+	target, candidates := resolveUser(msg.To, server.Addrs.Users())
+	if len(candidates) > 1 {
+		return "", errors.New(ambiguousUser(msg.To, candidates))
+	}
+	if !server.Addrs.Online(target) {
+		return "", errors.New(fmt.Sprintf("User %s isn't online.", msg.To))
+	}
+	if target == msg.User {
+		return "", errors.New("You can't add yourself as a friend.")
+	}
+	return target, nil
+}
+
+// Sends a message about the user coming online or going offline to the global group, which is
+// created if it doesn't exist. When
+// FriendsOnlyPresence is set, only users who have them as a friend are shown it, while the
+// rest are still sent the message without any text so they can update their cache. Any errors
+// are sent to the channel, which is closed once everyone has been sent to
+func (server *Server) sendPresence(msg *gochat.Msg, c chan error) {
+	// Presence is always sent to global, so make sure it exists
+	group := server.globalGroup()
+	if !server.FriendsOnlyPresence {
+		server.SendGroupMsg(msg, c)
+		return
+	}
+	for _, user := range group.Users.Array() {
+		if user == msg.User || !server.Addrs.Online(user) {
+			continue
+		}
+		//shallow copy
+		response := *msg
+		response.Msg = ""
+		if server.isFriend(user, msg.User) {
+			response.Msg = fmt.Sprintf("%s %s", server.groupPrefix(msg.To), msg.Msg)
+		}
+		if err := server.SendMsg(&response, user); err != nil {
+			c <- err
+		}
+	}
+	close(c)
+}
@@ -0,0 +1,76 @@
+package svr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A command users can send the Server, as listed by 'help'
+type commandDoc struct {
+	Usage string // the command and its arguments
+	Description string
+}
+
+// The commands users can send the Server, in the order 'help' lists them. Commands only sent
+// by clients and peers themselves, such as init and disconnect, aren't listed
+var commandDocs = []commandDoc{
+	{"join <group>", "Joins the group."},
+	{"leave <group>", "Leaves the group."},
+	{"move <group> <new group>", "Leaves the group and joins the new group at once."},
+	{"create <group>", "Creates the group, owned by you."},
+	{"delete <group>", "Deletes a group you own."},
+	{"rename <group> <new name>", "Renames a group you own."},
+	{"group <group> <msg>", "Sends msg to the group."},
+	{"reply <id> <msg>", "Replies to the group message with the ID."},
+	{"delivery <id>", "Shows how many members haven't received the group message with the ID."},
+	{"dm <user> <msg>", "Sends msg to the user directly."},
+	{"key <user>", "Exchanges keys with the user to encrypt direct messages."},
+	{"list [pattern]", "Lists the groups on the server, optionally matching a pattern."},
+	{"owner <group>", "Shows who owns the group."},
+	{"owned", "Lists the groups you own."},
+	{"announceowned <msg>", "Sends msg to every group you own."},
+	{"kick <group> <user>", "Removes the user from a group you own or moderate."},
+	{"mod <group> <user>", "Makes the user a moderator of a group you own."},
+	{"tempmute <group> <user> <seconds>", "Mutes the user in a group you own or moderate."},
+	{"slowmode <group> <seconds>", "Limits how often members can message a group you own."},
+	{"freeze <group>", "Stops everyone but you sending messages to a group you own."},
+	{"unfreeze <group>", "Lets members send messages to a group you own again."},
+	{"clear <group>", "Wipes the history of a group you own."},
+	{"afk <group>", "Stops sending you the group's messages without leaving it."},
+	{"back <group>", "Starts sending you the group's messages again."},
+	{"limit <group> <n>", "Limits how many members a group you own can have."},
+	{"pin <group> <msg>", "Pins msg in a group you own or moderate."},
+	{"unpin <group>", "Removes the pinned message of a group you own or moderate."},
+	{"pinned <group>", "Shows the group's pinned message."},
+	{"activity <group>", "Shows how many messages were sent to the group lately."},
+	{"invite <group> <user1,user2,...>", "Invites the users to the group."},
+	{"invites", "Lists the groups you've been invited to."},
+	{"promote <user> <group>", "Creates the group with you and the user in it."},
+	{"display <name>", "Sets the name you're shown by."},
+	{"friend <user>", "Adds the user as a friend."},
+	{"unfriend <user>", "Removes the user as a friend."},
+	{"diff <group>", "Compares your cached members of the group to the server's."},
+	{"unread", "Shows how many messages you haven't seen in each group."},
+	{"validate <command> [args]", "Checks if the command would succeed."},
+	{"report <user> <reason>", "Reports the user's messages to the admins."},
+	{"reports", "Admin only. Lists the reports users have made."},
+	{"allusers", "Admin only. Lists every user who has ever connected."},
+	{"usergroups <user>", "Admin only. Lists the groups the user is in."},
+	{"addr <user>", "Admin only. Shows the addresses the user's messages are sent to."},
+	{"topgroups [n]", "Admin only. Lists the n largest groups."},
+	{"recent [n]", "Admin only. Lists the last n users to disconnect."},
+	{"help", "Lists the server's commands."},
+}
+
+// Returns the list of commands users can send the Server, leaving out any that are disabled
+func (server *Server) help() string {
+	help := "Server commands:"
+	for _, doc := range commandDocs {
+		// The command's name is the first word of its usage
+		if server.Disabled.Contains(strings.Fields(doc.Usage)[0]) {
+			continue
+		}
+		help += fmt.Sprintf("\n %s: %s", doc.Usage, doc.Description)
+	}
+	return help
+}
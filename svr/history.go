@@ -0,0 +1,244 @@
+package svr
+
+import (
+	"sync"
+	"time"
+	"github.com/zembrodt/gochat"
+	"github.com/zembrodt/gochat/strset"
+)
+
+// A group message kept in a History, along with which of its recipients haven't acked it yet
+type Record struct {
+	Msg gochat.Msg // the message as the user sent it, before formatting, without any payload
+	Time time.Time
+	index int // how many messages had been sent to the group, including this one
+	pending *strset.AtomicStringSet
+}
+
+// A direct message kept in a History until its recipient sends a read receipt for it
+type directRecord struct {
+	From, To string
+}
+
+// Keeps track of the most recent group messages sent on a Server, oldest first, and how many
+// of each group's messages each user has seen, along with the direct messages that haven't been
+// read yet. Thread-safe
+type History struct {
+	records []*Record
+	byID map[string]*Record
+	direct map[string]directRecord // unread direct messages by ID
+	directIDs []string // IDs of the most recent direct messages, oldest first, read or not
+	limit int // how many records are kept before the oldest are dropped
+	counts map[string]int // how many messages have been sent to each group
+	seen map[string]map[string]int // how many of each group's messages each user has seen
+	lock sync.RWMutex
+}
+
+// How many messages a Server's History keeps by default
+const defaultHistoryLimit = 1000
+
+// Constructor function for History, keeping up to limit messages
+func NewHistory(limit int) *History {
+	return &History{
+		byID: make(map[string]*Record),
+		direct: make(map[string]directRecord),
+		limit: limit,
+		counts: make(map[string]int),
+		seen: make(map[string]map[string]int),
+	}
+}
+
+// Records a message that was sent to the given recipients, who are expected to ack it.
+// Only the filename of an attached file is kept, not its payload.
+// Drops the oldest message if the History is full
+func (history *History) Add(msg gochat.Msg, recipients []string) {
+	msg.Payload = nil
+	record := &Record{msg, time.Now(), 0, strset.NewAtomicStringSetFromSlice(recipients)}
+	history.lock.Lock()
+	history.counts[msg.To]++
+	record.index = history.counts[msg.To]
+	// The sender has seen their own message
+	history.markSeen(msg.User, msg.To, record.index)
+	history.records = append(history.records, record)
+	history.byID[msg.ID] = record
+	if len(history.records) > history.limit {
+		delete(history.byID, history.records[0].Msg.ID)
+		history.records = history.records[1:]
+	}
+	history.lock.Unlock()
+}
+
+// Marks the message with the given ID as delivered to and seen by the user.
+// Returns false if the message isn't in the History or wasn't waiting on the user
+func (history *History) Ack(id, user string) (ok bool) {
+	history.lock.Lock()
+	record, ok := history.byID[id]
+	if ok {
+		history.markSeen(user, record.Msg.To, record.index)
+	}
+	history.lock.Unlock()
+	if ok {
+		ok = record.pending.Remove(user)
+	}
+	return
+}
+
+// Records a direct message sent from one user to another, so its recipient can send a read
+// receipt for it. Only the most recent direct messages, as many as the History's limit, are kept
+func (history *History) AddDirect(id, from, to string) {
+	history.lock.Lock()
+	history.direct[id] = directRecord{from, to}
+	history.directIDs = append(history.directIDs, id)
+	if len(history.directIDs) > history.limit {
+		// Forget the oldest, if it hasn't already been read
+		delete(history.direct, history.directIDs[0])
+		history.directIDs = history.directIDs[1:]
+	}
+	history.lock.Unlock()
+}
+
+// Marks the direct message with the given ID, sent from one user to another, as read.
+// Returns false if no such message is in the History, or it was already read
+func (history *History) ReadDirect(id, from, to string) (ok bool) {
+	history.lock.Lock()
+	record, ok := history.direct[id]
+	ok = ok && record.From == from && record.To == to
+	if ok {
+		delete(history.direct, id)
+	}
+	history.lock.Unlock()
+	return
+}
+
+// Marks all messages sent to the group so far as seen by the user, such as when they join it
+func (history *History) MarkAllSeen(user, group string) {
+	history.lock.Lock()
+	history.markSeen(user, group, history.counts[group])
+	history.lock.Unlock()
+}
+
+// Returns how many messages the user hasn't seen in each of the given groups, leaving out
+// groups with none unseen
+func (history *History) Unread(user string, groups []string) (unread map[string]int) {
+	unread = make(map[string]int)
+	history.lock.RLock()
+	for _, group := range groups {
+		if count := history.counts[group] - history.seen[user][group]; count > 0 {
+			unread[group] = count
+		}
+	}
+	history.lock.RUnlock()
+	return
+}
+
+// Moves the messages, message counts, and what users have seen of a group to its new name
+func (history *History) RenameGroup(oldName, newName string) {
+	history.lock.Lock()
+	for _, record := range history.records {
+		if record.Msg.To == oldName {
+			record.Msg.To = newName
+		}
+	}
+	history.counts[newName] = history.counts[oldName]
+	delete(history.counts, oldName)
+	for _, userSeen := range history.seen {
+		if index, ok := userSeen[oldName]; ok {
+			userSeen[newName] = index
+			delete(userSeen, oldName)
+		}
+	}
+	history.lock.Unlock()
+}
+
+// Records the user has seen the group's messages up to the given index, unless they've already
+// seen further. The write lock must be held
+func (history *History) markSeen(user, group string, index int) {
+	userSeen, ok := history.seen[user]
+	if !ok {
+		userSeen = make(map[string]int)
+		history.seen[user] = userSeen
+	}
+	if index > userSeen[group] {
+		userSeen[group] = index
+	}
+}
+
+// Removes every message sent to the group, and forgets how many there were and how many each
+// user has seen, so none of them count as unread. Returns how many messages were removed
+func (history *History) Clear(group string) (removed int) {
+	history.lock.Lock()
+	kept := history.records[:0]
+	for _, record := range history.records {
+		if record.Msg.To == group {
+			delete(history.byID, record.Msg.ID)
+			removed++
+		} else {
+			kept = append(kept, record)
+		}
+	}
+	// Drop the references left past the end so the removed records can be collected
+	for i := len(kept); i < len(history.records); i++ {
+		history.records[i] = nil
+	}
+	history.records = kept
+	delete(history.counts, group)
+	for _, userSeen := range history.seen {
+		delete(userSeen, group)
+	}
+	history.lock.Unlock()
+	return
+}
+
+// Returns the messages still in the History sent to the group by other users since the last
+// one the user has seen, oldest first
+func (history *History) Unseen(user, group string) (msgs []gochat.Msg) {
+	history.lock.RLock()
+	seen := history.seen[user][group]
+	for _, record := range history.records {
+		if record.Msg.To == group && record.index > seen && record.Msg.User != user {
+			msgs = append(msgs, record.Msg)
+		}
+	}
+	history.lock.RUnlock()
+	return
+}
+
+// Returns how many messages still in the History were sent to the group since the given time,
+// and a boolean if that's all of them, which it isn't if older messages sent since then have
+// been dropped to make room
+func (history *History) CountSince(group string, since time.Time) (count int, complete bool) {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+	// Records are oldest first, so count back from the newest until they're too old
+	i := len(history.records) - 1
+	for ; i >= 0 && !history.records[i].Time.Before(since); i-- {
+		if history.records[i].Msg.To == group {
+			count++
+		}
+	}
+	complete = i >= 0 || len(history.records) < history.limit
+	return
+}
+
+// Returns the message with the given ID, and a boolean if the message is in the History
+func (history *History) Get(id string) (msg gochat.Msg, ok bool) {
+	history.lock.RLock()
+	record, ok := history.byID[id]
+	if ok {
+		msg = record.Msg
+	}
+	history.lock.RUnlock()
+	return
+}
+
+// Returns how many recipients haven't acked the message with the given ID, and a boolean if
+// the message is in the History
+func (history *History) Undelivered(id string) (count int, ok bool) {
+	history.lock.RLock()
+	record, ok := history.byID[id]
+	history.lock.RUnlock()
+	if ok {
+		count = record.pending.Size()
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package svr
+
+import (
+	"sort"
+	"sync"
+	"github.com/zembrodt/gochat/strset"
+)
+
+// Keeps track of the groups each user has been invited to and hasn't joined yet. Thread-safe
+type Invites struct {
+	pending map[string]*strset.StringSet // groups each user has been invited to
+	lock sync.RWMutex
+}
+
+// Constructor function for Invites
+func NewInvites() *Invites {
+	return &Invites{pending: make(map[string]*strset.StringSet)}
+}
+
+// Records the user as invited to the group. Returns false if they already were
+func (invites *Invites) Add(user, group string) bool {
+	invites.lock.Lock()
+	defer invites.lock.Unlock()
+	groups, ok := invites.pending[user]
+	if !ok {
+		groups = strset.NewStringSet()
+		invites.pending[user] = groups
+	}
+	return groups.Add(group)
+}
+
+// Removes the user's invite to the group, such as once they join it. Returns false if they
+// weren't invited
+func (invites *Invites) Consume(user, group string) bool {
+	invites.lock.Lock()
+	defer invites.lock.Unlock()
+	groups, ok := invites.pending[user]
+	if !ok || !groups.Contains(group) {
+		return false
+	}
+	groups.Remove(group)
+	if groups.Size() == 0 {
+		delete(invites.pending, user)
+	}
+	return true
+}
+
+// Returns the sorted names of the groups the user has been invited to
+func (invites *Invites) Pending(user string) (groupNames []string) {
+	invites.lock.RLock()
+	if groups, ok := invites.pending[user]; ok {
+		groupNames = groups.Array()
+	}
+	invites.lock.RUnlock()
+	sort.Strings(groupNames)
+	return
+}
+
+// Moves every invite to the group to its new name
+func (invites *Invites) RenameGroup(oldName, newName string) {
+	invites.lock.Lock()
+	for _, groups := range invites.pending {
+		if groups.Contains(oldName) {
+			groups.Remove(oldName)
+			groups.Add(newName)
+		}
+	}
+	invites.lock.Unlock()
+}
+
+// Removes every invite to the group, such as once it's deleted
+func (invites *Invites) RemoveGroup(group string) {
+	invites.lock.Lock()
+	for user, groups := range invites.pending {
+		groups.Remove(group)
+		if groups.Size() == 0 {
+			delete(invites.pending, user)
+		}
+	}
+	invites.lock.Unlock()
+}
@@ -0,0 +1,55 @@
+package svr
+
+import (
+	"sync"
+	"time"
+)
+
+// A user disconnecting from the Server
+type Disconnect struct {
+	User string
+	Time time.Time
+}
+
+// Keeps the most recent disconnects, forgetting the oldest once it is full. Thread-safe
+type DisconnectLog struct {
+	entries []Disconnect // ring buffer of disconnects in the order they happened
+	next int // index in entries the next disconnect is added at
+	count int // how many of entries are filled
+	lock sync.Mutex
+}
+
+// How many disconnects a Server's DisconnectLog keeps by default
+const defaultDisconnectLogSize = 100
+
+// Constructor function for DisconnectLog, keeping up to size disconnects
+func NewDisconnectLog(size int) *DisconnectLog {
+	return &DisconnectLog{entries: make([]Disconnect, size)}
+}
+
+// Records the user disconnecting at the given time
+func (log *DisconnectLog) Add(user string, at time.Time) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if len(log.entries) == 0 {
+		return
+	}
+	log.entries[log.next] = Disconnect{user, at}
+	log.next = (log.next + 1) % len(log.entries)
+	if log.count < len(log.entries) {
+		log.count++
+	}
+}
+
+// Returns the last n disconnects, most recent first
+func (log *DisconnectLog) Last(n int) (disconnects []Disconnect) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if n > log.count {
+		n = log.count
+	}
+	for i := 1; i <= n; i++ {
+		disconnects = append(disconnects, log.entries[(log.next-i+len(log.entries))%len(log.entries)])
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package svr
+
+import (
+	"sync"
+	"time"
+)
+
+// A report a user made about another user's messages
+type Report struct {
+	Reporter, Target string
+	Reason string
+	Groups []string // groups the reporter and target were both in when it was made
+	Time time.Time
+}
+
+// Keeps the most recent reports, dropping the oldest once it is full. Thread-safe
+type Reports struct {
+	reports []Report // oldest first
+	limit int
+	lock sync.Mutex
+}
+
+// How many reports a Server keeps by default
+const defaultReportLimit = 100
+
+// Constructor function for Reports, keeping up to limit reports
+func NewReports(limit int) *Reports {
+	return &Reports{limit: limit}
+}
+
+// Records the report, dropping the oldest if there are already limit reports
+func (reports *Reports) Add(report Report) {
+	reports.lock.Lock()
+	defer reports.lock.Unlock()
+	if reports.limit <= 0 {
+		return
+	}
+	if len(reports.reports) >= reports.limit {
+		// Copy rather than reslice so the dropped reports can be freed
+		reports.reports = append([]Report(nil), reports.reports[len(reports.reports)-reports.limit+1:]...)
+	}
+	reports.reports = append(reports.reports, report)
+}
+
+// Returns a copy of the reports, oldest first
+func (reports *Reports) All() []Report {
+	reports.lock.Lock()
+	defer reports.lock.Unlock()
+	return append([]Report(nil), reports.reports...)
+}
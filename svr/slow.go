@@ -0,0 +1,106 @@
+package svr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"github.com/zembrodt/gochat"
+)
+
+// A device whose sends have been timing out, which the Server skips for a while once it's
+// timed out SlowAfter times in a row, rather than let it hold up everyone else's messages
+type slowDevice struct {
+	timeouts int // sends to it in a row that timed out
+	skipUntil time.Time // when to try sending to it again
+}
+
+// Returned by SendMsg when every one of the user's devices is being skipped for being slow
+var errSkipped = errors.New("skipped slow recipient")
+
+// Most times a slow device's SlowSkip is doubled, so it's never skipped for too long at once
+const maxSlowDoublings = 6
+
+// Returns if the device at the address is slow and still being skipped
+func (server *Server) skipSlow(address string) bool {
+	server.slowLock.Lock()
+	defer server.slowLock.Unlock()
+	device, ok := server.slow[address]
+	return ok && time.Now().Before(device.skipUntil)
+}
+
+// Records how sending to the user's device at the address went. Each timeout in a row after
+// SlowAfter doubles how long the device is skipped for, and after SlowDropAfter it's dropped.
+// Anything other than a timeout means the device is keeping up, so it's no longer slow.
+// A device that can't be dialed at all is dropped straight away if the user has another
+func (server *Server) recordSend(user string, addr gochat.Addr, err error) {
+	address := addr.String()
+	// The device is gone, such as one that has since reconnected from another port, so stop
+	// sending to it. The user's last device is kept, so they can still reclaim their session
+	if isUnreachable(err) && len(server.Addrs.All(user)) > 1 {
+		server.slowLock.Lock()
+		delete(server.slow, address)
+		server.slowLock.Unlock()
+		go server.dropDevice(user, addr)
+		return
+	}
+	if server.SlowAfter <= 0 && server.SlowDropAfter <= 0 {
+		return
+	}
+	server.slowLock.Lock()
+	if !isTimeout(err) {
+		delete(server.slow, address)
+		server.slowLock.Unlock()
+		return
+	}
+	device, ok := server.slow[address]
+	if !ok {
+		device = &slowDevice{}
+		server.slow[address] = device
+	}
+	device.timeouts++
+	if server.SlowAfter > 0 && device.timeouts >= server.SlowAfter {
+		doublings := device.timeouts - server.SlowAfter
+		if doublings > maxSlowDoublings {
+			doublings = maxSlowDoublings
+		}
+		device.skipUntil = time.Now().Add(server.SlowSkip << uint(doublings))
+	}
+	drop := server.SlowDropAfter > 0 && device.timeouts >= server.SlowDropAfter
+	if drop {
+		delete(server.slow, address)
+	}
+	server.slowLock.Unlock()
+	if drop {
+		// Don't hold up the send that timed out while everyone is told they left
+		go server.dropDevice(user, addr)
+	}
+}
+
+// Disconnects the user's device at the address for being too slow or unreachable, taking the
+// user offline if it was their last one
+func (server *Server) dropDevice(user string, addr gochat.Addr) {
+	removed, last := server.Addrs.RemoveAddr(user, addr)
+	if !removed {
+		return
+	}
+	fmt.Printf("Dropped device %s of user %s.\n", addr.String(), user)
+	if last {
+		server.goOffline(user)
+	}
+}
+
+// Returns if sending failed because the receiver couldn't be dialed, other than by timing out
+func isUnreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout()
+}
+
+// Returns if sending failed because the receiver didn't take the message in time
+func isTimeout(err error) bool {
+	if err == gochat.ErrSendTimeout {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,123 @@
+package svr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/zembrodt/gochat"
+)
+
+// The Server's users, sessions, and groups at one moment, which can be saved to disk with
+// SaveSnapshot and restored after a restart with LoadSnapshot
+type Snapshot struct {
+	Time time.Time `json:"time"`
+	Addrs map[string][]gochat.Addr `json:"addrs"` // addresses of each online user's devices
+	Sessions map[string]SessionState `json:"sessions"`
+	Groups []gochat.GroupState `json:"groups"`
+	SeenUsers []string `json:"seenUsers"`
+}
+
+// A user's session as saved in a Snapshot
+type SessionState struct {
+	Token string `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Takes a Snapshot of the Server. Each map is copied under its read lock, so is consistent on
+// its own, though a user may connect or disconnect between them being copied
+func (server *Server) Snapshot() *Snapshot {
+	snapshot := &Snapshot{
+		Time: time.Now(),
+		Addrs: server.Addrs.Export(),
+		Sessions: make(map[string]SessionState),
+		Groups: server.Groups.Export(),
+		SeenUsers: server.SeenUsers.SortedArray(),
+	}
+	server.sessionLock.Lock()
+	for user, userSession := range server.sessions {
+		snapshot.Sessions[user] = SessionState{userSession.token, userSession.expires}
+	}
+	server.sessionLock.Unlock()
+	return snapshot
+}
+
+// Replaces the Server's users, sessions, and groups with those in the Snapshot. Sessions that
+// have expired since it was taken are dropped
+func (server *Server) Restore(snapshot *Snapshot) {
+	server.Addrs.Import(snapshot.Addrs)
+	server.Groups.Import(snapshot.Groups)
+	server.SeenUsers.AddAll(snapshot.SeenUsers)
+	now := time.Now()
+	server.sessionLock.Lock()
+	server.sessions = make(map[string]session)
+	for user, state := range snapshot.Sessions {
+		if now.Before(state.Expires) {
+			server.sessions[user] = session{state.Token, state.Expires}
+		}
+	}
+	server.sessionLock.Unlock()
+}
+
+// Writes a Snapshot of the Server to the file at path as JSON. It's written to a temporary file
+// in the same directory which is then renamed over path, so a crash partway through leaves the
+// previous snapshot intact rather than a corrupt one
+func (server *Server) SaveSnapshot(path string) error {
+	data, err := json.Marshal(server.Snapshot())
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+	if err != nil {
+		return err
+	}
+	// Clean up the temporary file if it doesn't make it to path
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Make sure the data is on disk before the rename makes it the snapshot
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restores the Server from the Snapshot saved by SaveSnapshot in the file at path. Nothing is
+// restored unless the whole file can be read
+func (server *Server) LoadSnapshot(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	snapshot := &Snapshot{}
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		return errors.New(fmt.Sprintf("File %s isn't a valid snapshot: %s", path, err))
+	}
+	server.Restore(snapshot)
+	return nil
+}
+
+// Saves a Snapshot to AutosavePath every AutosaveInterval until stop is closed
+func (server *Server) autosave(stop <-chan struct{}) {
+	ticker := time.NewTicker(server.AutosaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := server.SaveSnapshot(server.AutosavePath); err != nil {
+				fmt.Println("Error autosaving snapshot:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
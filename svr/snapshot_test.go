@@ -0,0 +1,87 @@
+package svr
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"github.com/zembrodt/gochat"
+)
+
+func TestSnapshotSaveLoad(t *testing.T) {
+	server := NewServer("server", nil)
+	server.Addrs.Add("ryan", gochat.Addr{Address: "10.0.0.1", Port: "1"})
+	server.Addrs.Add("ryan", gochat.Addr{Address: "10.0.0.2", Port: "2"})
+	server.Addrs.Add("mike", gochat.Addr{Address: "10.0.0.3", Port: "3"})
+	server.SeenUsers.AddAll([]string{"ryan", "mike", "tony"})
+	token := server.startSession("ryan")
+	server.Groups.Create("team", "ryan")
+	server.Groups.AddUser("team", "ryan")
+	server.Groups.AddUser("team", "mike")
+	server.Groups.AddModerator("team", "mike")
+	server.Groups.SetPin("team", "welcome")
+	server.Groups.SetLimit("team", 5)
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := server.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %s", err)
+	}
+	restored := NewServer("server", nil)
+	if err := restored.LoadSnapshot(path); err != nil {
+		t.Fatalf("LoadSnapshot: %s", err)
+	}
+	if got, want := restored.Addrs.Export(), server.Addrs.Export(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored addresses %v, want %v", got, want)
+	}
+	if got, want := restored.Groups.Export(), server.Groups.Export(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored groups %+v, want %+v", got, want)
+	}
+	if got, want := restored.SeenUsers.SortedArray(), server.SeenUsers.SortedArray(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored seen users %v, want %v", got, want)
+	}
+	if groups := restored.Groups.UserGroups("mike"); !reflect.DeepEqual(groups, []string{"team"}) {
+		t.Errorf("Restored index has mike in %v, want [team]", groups)
+	}
+	if !restored.renewSession("ryan", token) {
+		t.Error("ryan's session token wasn't restored")
+	}
+}
+
+func TestSnapshotExpiredSessions(t *testing.T) {
+	server := NewServer("server", nil)
+	server.Restore(&Snapshot{Sessions: map[string]SessionState{
+		"ryan": {Token: "current", Expires: time.Now().Add(time.Hour)},
+		"mike": {Token: "expired", Expires: time.Now().Add(-time.Hour)},
+	}})
+	if !server.renewSession("ryan", "current") {
+		t.Error("An unexpired session wasn't restored")
+	}
+	if server.renewSession("mike", "expired") {
+		t.Error("An expired session was restored")
+	}
+}
+
+func TestLoadSnapshotInvalid(t *testing.T) {
+	dir := t.TempDir()
+	server := NewServer("server", nil)
+	server.Groups.Create("team", "ryan")
+	if err := server.LoadSnapshot(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("LoadSnapshot of a missing file didn't return an error")
+	}
+	path := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(path, []byte(`{"groups": [`), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := server.LoadSnapshot(path); err == nil {
+		t.Error("LoadSnapshot of a corrupt file didn't return an error")
+	}
+	// Nothing is restored unless the whole file can be read
+	if _, ok := server.Groups.Get("team"); !ok {
+		t.Error("A failed LoadSnapshot changed the Server's groups")
+	}
+	// Saving into a directory that doesn't exist fails rather than writing elsewhere
+	if err := server.SaveSnapshot(filepath.Join(dir, "missing", "snapshot.json")); err == nil {
+		t.Error("SaveSnapshot into a missing directory didn't return an error")
+	}
+}
@@ -0,0 +1,52 @@
+package svr
+
+import (
+	"github.com/zembrodt/gochat"
+)
+
+// How many messages a subscriber can fall behind by before further messages to it are dropped
+const subscribeBuffer = 256
+
+// Returns a channel sent a copy of every message the Server accepts, once it's been handled, for
+// bots, bridges to other chat systems and the like. Commands that are disabled or fail validation
+// aren't sent. Each subscriber gets every message, but one that falls too far behind has messages
+// dropped rather than holding up the Server
+// NOTE: The copies have their Token cleared, since it's the sender's session secret
+func (server *Server) Subscribe() <-chan gochat.Msg {
+	c := make(chan gochat.Msg, subscribeBuffer)
+	server.subLock.Lock()
+	server.subscribers = append(server.subscribers, c)
+	server.subLock.Unlock()
+	return c
+}
+
+// Stops sending messages to a channel returned by Subscribe, and closes it
+func (server *Server) Unsubscribe(c <-chan gochat.Msg) {
+	server.subLock.Lock()
+	defer server.subLock.Unlock()
+	for i, sub := range server.subscribers {
+		if sub == c {
+			server.subscribers = append(server.subscribers[:i], server.subscribers[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+// Sends a copy of the message to every subscriber with room for it
+func (server *Server) publish(msg *gochat.Msg) {
+	server.subLock.Lock()
+	defer server.subLock.Unlock()
+	if len(server.subscribers) == 0 {
+		return
+	}
+	copied := *msg
+	copied.Token = ""
+	for _, sub := range server.subscribers {
+		select {
+		case sub <- copied:
+		default:
+			// Subscriber is too far behind, drop it rather than wait
+		}
+	}
+}
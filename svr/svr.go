@@ -10,11 +10,25 @@ package svr
 
 import (
     "fmt"
+	"math"
 	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"github.com/zembrodt/gochat"
+	"github.com/zembrodt/gochat/strset"
 	"errors"
+	"io"
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 )
 
 // A server is constructed out of an address to listen on and a pointer to maps of
@@ -23,14 +37,234 @@ type Server struct {
 	address string
 	Addrs *gochat.AddrMap
 	Groups *gochat.GroupMap
+	Transport gochat.Transport // used to send messages out to clients
+	History *History // recent group messages and who has received them
+	Invites *Invites // groups each user has been invited to but hasn't joined
+	Disconnects *DisconnectLog // users who most recently disconnected
+	Reports *Reports // reports users made about other users' messages
+	NotifyReports bool // whether online admins are sent each report as it's made
+	lastID uint64 // last message ID assigned, accessed atomically
+	Cooldown time.Duration // minimum time between uses of a cooldownCmds command by a user, 0 to disable
+	lastUsed map[cooldownKey]time.Time // when each user last used each cooldownCmds command
+	cooldownLock sync.Mutex
+	MaxConns int // maximum connections handled at once, 0 for unlimited
+	ShedThreshold int // connections handled at once past which new ones are shed, 0 to disable
+	MaxConnsPerIP int // maximum connections handled at once from a single IP, 0 for unlimited
+	MaxGroupSize int // most members any group may have, 0 for unlimited
+	MaxGroupsPerUser int // most groups a user may own at once, 0 for unlimited
+	ipConns map[string]int // connections being handled from each IP
+	ipConnLock sync.Mutex
+	activeConns int64 // connections being handled, accessed atomically
+	overloaded int32 // set to 1 to shed connections regardless of load, accessed atomically
+	AuditWriter io.Writer // optional append-only log every command handled is written to
+	auditLock sync.Mutex
+	Hooks Hooks // optional functions called as events happen on the Server
+	ShowMemberCount bool // whether join notices include the group's new member count
+	ShowRoles bool // whether group messages from owners and moderators are tagged with their role
+	GlobalAlias string // name the global group is shown as in messages, such as "lobby", empty to show "global"
+	ReplayMissed bool // whether users coming back to a group are sent the messages they missed
+	SessionTTL time.Duration // how long a user's session token lets them reclaim their name
+	sessions map[string]session // each online user's session
+	sessionLock sync.Mutex
+	RequireSignatures bool // whether messages must be signed with the sender's session token
+	SignatureMaxAge time.Duration // how long after it's signed a message is accepted
+	nonces map[string]time.Time // when each signed message accepted recently was signed, by nonce
+	noncesPruned time.Time // when nonces was last cleared of stale messages
+	nonceLock sync.Mutex
+	PeerSecret string // secret shared by federated servers to sign what they send each other
+	AllowedPeers *strset.AtomicStringSet // addresses of the servers allowed to federate with this one
+	Admins *strset.AtomicStringSet // users allowed to use admin commands
+	SeenUsers *strset.AtomicStringSet // every user who has connected, saved in snapshots
+	AutosavePath string // file a Snapshot is loaded from by Listen and autosaved to, empty for none
+	AutosaveInterval time.Duration // how often a Snapshot is autosaved, 0 to only load it
+	Disabled *strset.AtomicStringSet // commands users aren't allowed to use, except requiredCmds
+	BufferSize int // size of the read and write buffers each connection is wrapped in, 0 for none
+	filter *regexp.Regexp // matches banned words in messages, nil if there are none
+	filterLock sync.RWMutex
+	Normalization Normalization // how the text of group and direct messages is cleaned up
+	SendRetries int // how many more times a failed group message is sent to a member, 0 to disable
+	SlowAfter int // sends in a row to a device that time out before it's skipped, 0 to never skip
+	SlowSkip time.Duration // how long a slow device is skipped for, doubled after each further timeout
+	SlowDropAfter int // sends in a row to a device that time out before it's dropped, 0 to never drop
+	slow map[string]*slowDevice // devices whose sends have been timing out, by address
+	slowLock sync.Mutex
+	subscribers []chan gochat.Msg // channels returned by Subscribe
+	subLock sync.Mutex
+	BotName string // name replies from handlers registered with HandleBot are sent as, "bot" if empty
+	bots map[string]BotHandler // bot handlers by the prefix of the command they answer
+	botLock sync.RWMutex
+	RetryBackoff time.Duration // wait before the first retry to a member, doubled after each
+	Greetings Greetings // formats of the notices sent when users join or leave groups
+	Peers *strset.AtomicStringSet // addresses of the servers federated with this one
+	PeerAddress string // address peers reach this Server at, if it isn't the one it listens on
+	locations map[string]string // which peer each user connected to a peer is on
+	locationLock sync.RWMutex
+	lastPosted map[memberKey]time.Time // when each user last sent a message to each group
+	displayNames map[string]string // names users are shown by, if they differ from their login
+	displayLock sync.RWMutex
+	friends map[string]*strset.StringSet // users each user has added as friends
+	friendLock sync.RWMutex
+	FriendsOnlyPresence bool // whether online and offline notices are only shown to friends
+	slowModeLock sync.Mutex
+	mutes map[memberKey]time.Time // when each muted user can send messages to the group again
+	muteLock sync.Mutex
 }
 
-// Constructor function for Server
-func NewServer(address string) *Server {
-	return &Server{address, gochat.NewAddrMap(), gochat.NewGroupMap()}
+// A user's session, which they can reclaim by presenting its token when reconnecting before
+// it expires, rather than being rejected because their stale address is still on the Server
+type session struct {
+	token string
+	expires time.Time
+}
+
+// Functions an embedding application can set to react to events on the Server. Any left nil
+// are skipped. Hooks are called from HandleRequest without any of the Server's map locks held,
+// so they're free to call back into the Server, but may be called from many goroutines at once.
+type Hooks struct {
+	OnUserJoin func(user, group string) // user joined the group, including global on connecting
+	OnUserLeave func(user, group string) // user left, was kicked from, or disconnected from the group
+	OnMessage func(msg gochat.Msg) // a group or direct message was sent, before formatting
+	OnGroupCreate func(group, owner string) // owner created the group
+}
+
+// Formats of the notices sent to a group when its members change, so they can be customized or
+// localized. Each is a fmt format given the user's name, and JoinedCount is also given the
+// group's new member count followed by "member" or "members"
+type Greetings struct {
+	Online string // user connected, sent to the global group
+	Joined string // user joined the group
+	JoinedCount string // user joined the group, used instead of Joined when ShowMemberCount is set
+	Left string // user left or disconnected from the group
+	Kicked string // user was kicked from the group
+}
+
+// The Greetings a Server uses unless they're changed
+var DefaultGreetings = Greetings{
+	Online: "%s is online.",
+	Joined: "%s has joined the group.",
+	JoinedCount: "%s has joined the group (now %d %s).",
+	Left: "%s has left the group.",
+	Kicked: "%s has been kicked from the group.",
+}
+
+// A line of the audit log, written as JSON
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	User string `json:"user"`
+	Cmd string `json:"cmd"`
+	To string `json:"to"`
+	Msg string `json:"msg"` // truncated to auditPreviewLen characters
+}
+
+// How much of a message's contents is kept in the audit log
+const auditPreviewLen = 64
+
+// The spans of time the activity command counts a group's messages over
+var activityWindows = []struct{
+	Name string
+	Duration time.Duration
+}{
+	{"minute", time.Minute},
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+}
+
+// How long after it's signed a message is accepted by default, allowing for clocks that are
+// a little off
+const defaultSignatureMaxAge = 2 * time.Minute
+
+// How long a slow device is first skipped for by default
+const defaultSlowSkip = 5 * time.Second
+
+// How long the health command waits to read the Server's maps before reporting it unresponsive
+const healthTimeout = time.Second
+
+// Size of the buffers a Server wraps each connection in by default
+const defaultBufferSize = 4096
+
+// How many groups topgroups lists, and disconnects recent lists, if a number isn't given
+const (
+	defaultTopGroups = 10
+	defaultRecent = 10
+)
+
+// Commands clients need to connect and disconnect, which can't be disabled
+var requiredCmds = map[string]bool{"init": true, "disconnect": true}
+
+// Commands that aren't signed by a user even when the Server requires signatures, since they're
+// sent before the user has a session, or by peers, which sign them with the PeerSecret instead
+var unsignedCmds = map[string]bool{"init": true, "peer": true, "peerUser": true, "federate": true}
+
+// Commands that are destructive enough to be limited by the Server's Cooldown
+var cooldownCmds = map[string]bool{"create": true, "delete": true, "kick": true}
+
+// How many times a failed group message is retried to each member by default, and how long
+// to wait before the first retry
+const (
+	defaultSendRetries = 2
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Bounds of how long Listen waits before accepting again after an error
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Identifies a user's use of a command for cooldown tracking
+type cooldownKey struct {
+	user, cmd string
+}
+
+// Identifies a user in a group, for tracking slow mode and mutes
+type memberKey struct {
+	user, group string
+}
+
+// Constructor function for Server. A nil transport uses a gochat.TCPTransport
+func NewServer(address string, transport gochat.Transport) *Server {
+	if transport == nil {
+		transport = &gochat.TCPTransport{}
+	}
+	return &Server{
+		address: address,
+		Addrs: gochat.NewAddrMap(),
+		Groups: gochat.NewGroupMap(),
+		Transport: transport,
+		History: NewHistory(defaultHistoryLimit),
+		Invites: NewInvites(),
+		Disconnects: NewDisconnectLog(defaultDisconnectLogSize),
+		Reports: NewReports(defaultReportLimit),
+		lastUsed: make(map[cooldownKey]time.Time),
+		SessionTTL: time.Hour,
+		sessions: make(map[string]session),
+		SignatureMaxAge: defaultSignatureMaxAge,
+		nonces: make(map[string]time.Time),
+		AllowedPeers: strset.NewAtomicStringSet(),
+		Admins: strset.NewAtomicStringSet(),
+		SeenUsers: strset.NewAtomicStringSet(),
+		Disabled: strset.NewAtomicStringSet(),
+		BufferSize: defaultBufferSize,
+		Normalization: NormalizeTrailing,
+		SendRetries: defaultSendRetries,
+		RetryBackoff: defaultRetryBackoff,
+		Greetings: DefaultGreetings,
+		Peers: strset.NewAtomicStringSet(),
+		locations: make(map[string]string),
+		lastPosted: make(map[memberKey]time.Time),
+		slow: make(map[string]*slowDevice),
+		bots: make(map[string]BotHandler),
+		SlowSkip: defaultSlowSkip,
+		mutes: make(map[memberKey]time.Time),
+		displayNames: make(map[string]string),
+		friends: make(map[string]*strset.StringSet),
+		ipConns: make(map[string]int),
+	}
 }
 
 // Tells a server to start listening on its port
+// NOTE: Requests are always accepted over TCP, since 'init' is answered on the same connection
+// and the client's address is taken from it. The Transport is only used to send messages out
 func (server *Server) Listen() (err error) {
 	listen, err := net.Listen("tcp", server.address)
 	if err != nil {
@@ -38,20 +272,186 @@ func (server *Server) Listen() (err error) {
 		return err //or put through chan?
 	}
 	defer listen.Close()
+	// Pick up where we left off if we were stopped or crashed, and keep saving our state
+	if server.AutosavePath != "" {
+		if err := server.LoadSnapshot(server.AutosavePath); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Error loading snapshot:", err)
+		}
+		if server.AutosaveInterval > 0 {
+			stop := make(chan struct{})
+			defer close(stop)
+			go server.autosave(stop)
+		}
+	}
+	// Counting semaphore of connections being handled, left nil if unlimited
+	var conns chan struct{}
+	if server.MaxConns > 0 {
+		conns = make(chan struct{}, server.MaxConns)
+	}
+	// How long to wait after a failed accept, which grows while they keep failing so a
+	// listener stuck in an error state (e.g. too many open files) doesn't spin
+	var acceptDelay time.Duration
 	// main loop
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			fmt.Println("Error on accept:", err)
+			if acceptDelay == 0 {
+				acceptDelay = minAcceptDelay
+			} else if acceptDelay *= 2; acceptDelay > maxAcceptDelay {
+				acceptDelay = maxAcceptDelay
+			}
+			fmt.Printf("Error on accept: %s; retrying in %v\n", err, acceptDelay)
+			time.Sleep(acceptDelay)
+			continue
+		}
+		acceptDelay = 0
+		if err = gochat.KeepAlive(conn, gochat.KeepAlivePeriod); err != nil {
+			fmt.Println("Error setting keepalive:", err)
+		}
+		// Turn the connection away while shedding load, before spending anything on it
+		if server.Shedding() {
+			go server.reject(conn, "Server is overloaded, please try again later.")
 			continue
 		}
+		// Drop the connection if its IP already has too many open, without spending a
+		// goroutine on it, so one host flooding the Server can't exhaust it
+		ip := remoteIP(conn)
+		if !server.takeIPSlot(ip) {
+			conn.Close()
+			continue
+		}
+		// Take a slot for the connection, turning it away if all are taken
+		if conns != nil {
+			select {
+			case conns <- struct{}{}:
+			default:
+				server.releaseIPSlot(ip)
+				go server.reject(conn, "Server is full, please try again later.")
+				continue
+			}
+		}
 		// Create goroutine to handle the connection
-		go server.HandleRequest(conn)
+		atomic.AddInt64(&server.activeConns, 1)
+		go func() {
+			defer atomic.AddInt64(&server.activeConns, -1)
+			defer server.releaseIPSlot(ip)
+			if conns != nil {
+				// Free the connection's slot once it's handled
+				defer func() { <-conns }()
+			}
+			server.HandleRequest(conn)
+		}()
+	}
+}
+
+// Returns the IP the connection came from, or its whole remote address if it isn't host:port,
+// such as a net.Pipe
+func remoteIP(conn net.Conn) string {
+	remote := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// Counts another connection being handled from the IP. Returns false without counting it if the
+// IP already has MaxConnsPerIP connections being handled
+func (server *Server) takeIPSlot(ip string) bool {
+	if server.MaxConnsPerIP <= 0 {
+		return true
+	}
+	server.ipConnLock.Lock()
+	defer server.ipConnLock.Unlock()
+	if server.ipConns[ip] >= server.MaxConnsPerIP {
+		return false
+	}
+	server.ipConns[ip]++
+	return true
+}
+
+// Stops counting a connection from the IP once it's been handled
+func (server *Server) releaseIPSlot(ip string) {
+	if server.MaxConnsPerIP <= 0 {
+		return
+	}
+	server.ipConnLock.Lock()
+	if server.ipConns[ip]--; server.ipConns[ip] <= 0 {
+		delete(server.ipConns, ip)
+	}
+	server.ipConnLock.Unlock()
+}
+
+// Returns whether the Server is currently turning away new connections, either because it was
+// told to with SetOverloaded or because it's handling ShedThreshold connections already
+func (server *Server) Shedding() bool {
+	if atomic.LoadInt32(&server.overloaded) == 1 {
+		return true
+	}
+	return server.ShedThreshold > 0 && atomic.LoadInt64(&server.activeConns) >= int64(server.ShedThreshold)
+}
+
+// Sets whether the Server should turn away all new connections, such as while an operator
+// knows it's under too much load
+func (server *Server) SetOverloaded(overloaded bool) {
+	var flag int32
+	if overloaded {
+		flag = 1
+	}
+	atomic.StoreInt32(&server.overloaded, flag)
+}
+
+// Encodes the reply to the connection, flushing it right away if the connection is buffered so
+// the client isn't left waiting on it
+func sendReply(conn net.Conn, encoder *gob.Encoder, reply *gochat.Msg) (err error) {
+	if err = encoder.Encode(reply); err != nil {
+		return
+	}
+	if buffered, ok := conn.(*gochat.BufferedConn); ok {
+		err = buffered.Flush()
+	}
+	return
+}
+
+// Returns the Server's status for health checks: OK, OVERLOADED if it's shedding connections, or
+// UNRESPONSIVE if its maps can't be read within healthTimeout, followed by how many users,
+// groups, and connections it has. Only read locks are taken, and it never waits longer than
+// healthTimeout
+func (server *Server) health() string {
+	type counts struct {
+		users, groups int
+	}
+	result := make(chan counts, 1)
+	go func() {
+		result <- counts{server.Addrs.Count(), server.Groups.Count()}
+	}()
+	select {
+	case c := <-result:
+		status := "OK"
+		if server.Shedding() {
+			status = "OVERLOADED"
+		}
+		return fmt.Sprintf("%s users=%d groups=%d conns=%d", status, c.users, c.groups, atomic.LoadInt64(&server.activeConns))
+	case <-time.After(healthTimeout):
+		return "UNRESPONSIVE"
+	}
+}
+
+// Replies to a connection the Server won't handle with a 'serverFull' Msg explaining why,
+// then closes it
+func (server *Server) reject(conn net.Conn, reason string) {
+	defer conn.Close()
+	encoder := gob.NewEncoder(conn)
+	if err := sendReply(conn, encoder, &gochat.Msg{Msg: reason, Cmd: "serverFull"}); err != nil {
+		fmt.Println("Encoding error:", err)
 	}
 }
 
 // Parses a message sent by the client and decides what message(s) to send out
 func (server *Server) HandleRequest(conn net.Conn) {
+	// Decode from a buffer rather than reading off the connection a few bytes at a time
+	if server.BufferSize > 0 {
+		conn = gochat.NewBufferedConn(conn, server.BufferSize)
+	}
 	defer conn.Close()
 	msg := &gochat.Msg{}
 	// Decode the message
@@ -60,197 +460,406 @@ func (server *Server) HandleRequest(conn net.Conn) {
 		fmt.Println("Error retrieving msg:",err)
 		return
 	}
-	fmt.Printf("Received : %+v\n", msg)
+	// Answer health checks straight away on the same connection, as they come from probes
+	// rather than users and are sent too often to log
+	if msg.Cmd == "health" {
+		if err = sendReply(conn, gob.NewEncoder(conn), &gochat.Msg{Msg: server.health(), Cmd: "health"}); err != nil {
+			fmt.Println("Encoding error:", err)
+		}
+		return
+	}
+	// Log a copy without the session token, which is also the user's signing key, or the
+	// payload, which can be a whole file
+	logged := *msg
+	logged.Token, logged.Payload = "", nil
+	fmt.Printf("Received : %+v\n", &logged)
+	server.audit(msg)
+	
+	// Drop the message if it wasn't signed by the user it claims to be from, or is a replay of
+	// one that was, since we can't tell them it was rejected without trusting who they claim to be
+	if server.RequireSignatures && !unsignedCmds[msg.Cmd] && (!server.signedBy(msg, msg.User) || !server.fresh(msg)) {
+		fmt.Printf("Dropped %s from %s: missing, invalid, or replayed signature\n", msg.Cmd, msg.User)
+		return
+	}
 	
 	addrs := server.Addrs
 	groups := server.Groups
 	
+	// Check the command would succeed before checkAllowed counts this use towards the Cooldown,
+	// which Validate would then fail it for
+	valid := server.Validate(msg) == nil
+	// Reject the command if the server doesn't allow it or the user has used it too recently
+	if err = server.checkAllowed(msg, true); err != nil {
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		response.Msg = err.Error()
+		err = server.SendMsg(response, response.User)
+		return
+	}
+	// Publish valid commands to subscribers once they've been handled. A copy is published as
+	// handling can change msg, and only once, so a handler can publish it early with publish()
+	publish := func() {}
+	if valid {
+		received := *msg
+		publish = func() {
+			server.publish(&received)
+			publish = func() {}
+		}
+	}
+	defer func() { publish() }()
+	
 	// Parse the message data
 	switch msg.Cmd {
 	case "init":
 		// User has just connected
+		// NOTE: The port the client is listening on will be in msg.Msg, the name they want to
+		// be shown by, if any, in msg.To, and if they are reconnecting, the token of their
+		// previous session will be in msg.Token
 		encoder := gob.NewEncoder(conn)
+		// build Addr out of the host the client connected from and the port it reported,
+		// as the remote port of this connection is ephemeral and can't be dialed back
+		addr, err := listenAddr(conn, msg.Msg)
+		if err != nil {
+			// The client didn't report a usable port, send 'invalidPort' so they exit
+			fmt.Println("Invalid listen port:", err)
+			err = sendReply(conn, encoder, &gochat.Msg{User: msg.User, Cmd: "invalidPort"})
+			if err != nil {
+				fmt.Println("Encoding error:", err)
+			}
+			return
+		}
+		// The bot's name is reserved, so it can't be taken by a user
+		if server.isBot(msg.User) {
+			err = sendReply(conn, encoder, &gochat.Msg{User: msg.User, Cmd: "alreadyExists"})
+			if err != nil {
+				fmt.Println("Encoding error:", err)
+			}
+			return
+		}
 		// if user is not in addrs
-		if _, ok := addrs.Get(msg.User); !ok {
-			// build Addr
-			addrStr := strings.Split(conn.RemoteAddr().String(), ":")
-			addr := gochat.Addr{addrStr[0], addrStr[1]}
-			
+		if !addrs.Online(msg.User) {
 			// add addr to map
 			addrs.Add(msg.User, addr)
+			server.SeenUsers.Add(msg.User)
+			displayErr := server.connectDisplayName(msg.User, msg.To)
 			
-			// send the port back to client so they know what to listen on
+			// send the port back to client to confirm where they'll be reached, along with
+			// the token they can reclaim their session with if they reconnect
 			fmt.Println("Sending user port",addr.Port)
-			err = encoder.Encode(addr.Port)
+			reply := &gochat.Msg{User: msg.User, Msg: addr.Port, Cmd: "init", Token: server.startSession(msg.User)}
+			err = sendReply(conn, encoder, reply)
 			if err != nil {
 				fmt.Println("Encoding error:",err)
 			}
 			
-			// Add client to global channel
-			if ok = groups.AddUser("global", msg.User); !ok {
-				groups.Create("global", "")
-				groups.AddUser("global", msg.User)
-			}
+			// Add client to global channel, which doesn't exist until the first client connects
+			global := server.globalGroup()
+			groups.AddUser("global", msg.User)
+			server.History.MarkAllSeen(msg.User, "global")
+			server.Hooks.userJoined(msg.User, "global")
+			server.announceUser(msg.User, "online")
 			
 			// Update client's global group cache
 			if addr, ok := addrs.Get(msg.User); ok {
-				group, _ := groups.Get("global")
-				for _, groupMember := range group.Users.Array() {
+				for _, groupMember := range global.Users.Array() {
 					if groupMember != msg.User {
 						cacheUpdate := &gochat.Msg{}
 						cacheUpdate.User = groupMember
 						cacheUpdate.To = "global"
 						cacheUpdate.Cmd = "join"
-						err = cacheUpdate.Send(addr.String())
+						err = server.Transport.Send(addr.String(), cacheUpdate)
 					}
 				}
 			}
 			// Create message to send out to all other users
-			msg.Msg = fmt.Sprintf("%s is online.", msg.User)
+			msg.Msg = fmt.Sprintf(server.Greetings.Online, server.displayName(msg.User))
 			msg.Cmd = "join" // so the other users know to update their cache
 			msg.To = "global"
 			errCh := make(chan error)
-			go server.SendGroupMsg(msg, errCh)
+			go server.sendPresence(msg, errCh)
 			// wait to see if SendGroupMsg encounters any errors
 			for {
-				if err, ok = <- errCh; ok {
+				if err, ok := <- errCh; ok {
 					fmt.Println("Group message error:", err)
 				} else {
 					break
 				}
 			}
+			server.displayNameRefused(msg.User, displayErr)
+			
+		} else if server.renewSession(msg.User, msg.Token) {
+			// User proved the session is theirs with its token, so they're reconnecting or
+			// connecting from another device. Their other devices may still be connected, so
+			// the new address is added alongside the others. They're still in all their groups,
+			// so no one else needs to be notified
+			addrs.Add(msg.User, addr)
+			displayErr := server.connectDisplayName(msg.User, msg.To)
+			// Make sure they're still in global in case it was removed while they were gone
+			server.globalGroup()
+			groups.AddUser("global", msg.User)
+			fmt.Println("Sending reconnected user port",addr.Port)
+			err = sendReply(conn, encoder, &gochat.Msg{User: msg.User, Msg: addr.Port, Cmd: "init", Token: msg.Token})
+			if err != nil {
+				fmt.Println("Encoding error:",err)
+			}
+			// Fill the device's cache with the groups the user is in and their members, in case
+			// it's a new device
+			for _, cacheUpdate := range server.cacheUpdates(msg.User) {
+				if err = server.Transport.Send(addr.String(), cacheUpdate); err != nil {
+					fmt.Println("Error updating device's cache:", err)
+				}
+			}
+			// Let them know what they missed while they were gone
+			if unread := server.unreadSummary(msg.User); unread != "" {
+				err = server.SendMsg(&gochat.Msg{User: msg.User, Msg: unread, Cmd: "unread"}, msg.User)
+			}
+			server.displayNameRefused(msg.User, displayErr)
 			
 		} else {
-			// User already exists, send the 'alreadyExists' response so they exit
-			err = encoder.Encode("alreadyExists")
+			// User already exists and didn't give their session's token, so whoever this is
+			// can't prove they're them. Send the 'alreadyExists' response so they exit
+			err = sendReply(conn, encoder, &gochat.Msg{User: msg.User, Cmd: "alreadyExists"})
 			if err != nil {
 				fmt.Println("Encoding error:", err)
 			}
 		}
 		
+	case "sync":
+		// User wants to rebuild their cache from the groups they're in and their members
+		for _, cacheUpdate := range server.cacheUpdates(msg.User) {
+			if err = server.SendMsg(cacheUpdate, msg.User); err != nil {
+				fmt.Println("Error syncing cache:", err)
+			}
+		}
+		
 	case "join":
 		// User wants to join a group
 		response := &gochat.Msg{}
 		*response = *msg // shallow copy
 		response.Cmd = ""
-		// Check if we were able to add the user to the group
-		if ok := groups.AddUser(msg.To, msg.User); ok {
-			response.Msg = fmt.Sprintf("You have joined the group %s.", msg.To)
-			response.Cmd = "join"
-			// Notify all users in the group that this user joined
-			msg.Msg = fmt.Sprintf("%s has joined the group.", msg.User)
-			errCh := make(chan error)
-			go server.SendGroupMsg(msg, errCh)
-			// Check for errors
-			for {
-				if err, ok = <- errCh; ok {
-					fmt.Println("Group message error:", err)
-				} else {
-					break
-				}
-			}
-			// Notify the user they joined
+		// Check the user can join the group and if we were able to add them
+		if err = server.validateJoin(msg); err != nil {
+			response.Msg = err.Error()
+			err = server.SendMsg(response, response.User)
+		} else if added := groups.AddUser(msg.To, msg.User); added == gochat.Added {
+			err = server.joined(msg.User, msg.To)
+		} else if added == gochat.AlreadyMember {
+			// The user joined from another device since we checked
+			response.Msg = fmt.Sprintf("You're already in the group %s.", msg.To)
 			err = server.SendMsg(response, response.User)
-			// Now send the user messages containing all groups currently in that group
-			// so they can update their local cache
-			group, _ := groups.Get(msg.To)
-			for _, groupMember := range group.Users.Array() {
-				if groupMember != msg.User {
-					cacheUpdate := &gochat.Msg{}
-					cacheUpdate.User = groupMember
-					cacheUpdate.To = msg.To
-					cacheUpdate.Cmd = "join"
-					server.SendMsg(cacheUpdate, msg.User)
-				}
-			}
 		} else {
-			// The group doesn't exist
+			// The group was deleted since we checked
 			response.Msg = fmt.Sprintf("Group %s doesn't exist.", msg.To)
 			err = server.SendMsg(response, response.User)
 		}
 		
 	case "dm":
 		// User wants to send a direct message to another user
-		// Create the message
+		// Resolve who the message is for, allowing a unique prefix of their name
+		to, err := server.validateDM(msg)
+		if err != nil {
+			// Let the user know who they might have meant, or that they're offline
+			response := &gochat.Msg{}
+			*response = *msg
+			response.Cmd = ""
+			response.Msg = err.Error()
+			err = server.SendMsg(response, response.User)
+			break
+		}
+		// Create the message, with an ID so the recipient can send back a read receipt
 		dmMsg := &gochat.Msg{}
-		dmMsg.Msg = fmt.Sprintf("%s whispers %s", msg.User, msg.Msg)
+		*dmMsg = *msg
+		dmMsg.To = to
+		if len(msg.Sealed) > 0 {
+			// The message is encrypted, so relay it as is for the recipient to decrypt
+			dmMsg.Msg = fmt.Sprintf("%s whispers", server.displayName(msg.User))
+		} else {
+			// Clean up the message and mask any banned words before sending it on
+			msg.Msg = server.filterWords(server.normalize(msg.Msg))
+			dmMsg.Msg = fmt.Sprintf("%s whispers %s", server.displayName(msg.User), msg.Msg)
+		}
+		dmMsg.ID = server.NextID()
+		server.History.AddDirect(dmMsg.ID, msg.User, to)
+		server.Hooks.message(msg, to)
 		// Send the message
-		server.SendMsg(dmMsg, msg.To)
+		server.SendMsg(dmMsg, to)
 		
-	case "group":
-		// User wants to send a message to a group
+	case "key":
+		// User wants to exchange public keys with another user, so relay their key
+		// NOTE: The public key will be in msg.Key
+		if to, err := server.validateDM(msg); err != nil {
+			response := &gochat.Msg{}
+			*response = *msg
+			response.Cmd = ""
+			response.Key = nil
+			response.Msg = err.Error()
+			err = server.SendMsg(response, response.User)
+		} else {
+			err = server.SendMsg(&gochat.Msg{User: msg.User, To: to, Cmd: "key", Key: msg.Key}, to)
+		}
+		
+	case "read":
+		// User has read a direct message, so relay the receipt to its sender
+		// NOTE: The sender of the direct message will be in msg.To and its ID in msg.ID
+		// Only relay receipts for direct messages the sender actually sent the user, so no one
+		// can send a receipt for a message they never received
+		if ok := server.History.ReadDirect(msg.ID, msg.To, msg.User); !ok {
+			fmt.Printf("Unexpected read receipt for message %s from user %s.\n", msg.ID, msg.User)
+			break
+		}
+		receipt := &gochat.Msg{}
+		*receipt = *msg
+		receipt.Msg = ""
+		err = server.SendMsg(receipt, msg.To)
+		
+	case "group", "reply":
+		// User wants to send a message to a group, which may have a file attached, or reply to
+		// a message sent to one
+		// NOTE: For a reply, the ID of the message being replied to will be in msg.To
+		var replyErr error
+		if msg.Cmd == "reply" {
+			// Send it as a group message to the parent's group, keeping which message it replies to
+			var group string
+			if group, replyErr = server.validateReply(msg); replyErr == nil {
+				msg.ReplyTo = msg.To
+				msg.To = group
+				msg.Cmd = "group"
+			}
+		}
 		response := &gochat.Msg{}
 		*response = *msg
 		response.Cmd = ""
+		response.Payload = nil // the user already has their own file
 		// Check if the user belongs to the group
-		if contains, ok := groups.ContainsUser(msg.To, msg.User); contains {
-			// Build the response message for the user
-			response.Msg = fmt.Sprintf("[%s] %s: %s", msg.To, msg.User, msg.Msg)
-			// Send the message to all other users in the group
-			msg.Msg = fmt.Sprintf("%s: %s", msg.User, msg.Msg)
-			errCh := make(chan error)
-			go server.SendGroupMsg(msg, errCh)
-			// Check for errors
-			for {
-				if err, ok = <- errCh; ok {
-					fmt.Println("Group message error:", err)
-				} else {
-					break
-				}
-			}
-		} else {
+		if replyErr != nil {
+			// The message being replied to isn't in a group the user is in
+			response.Msg = replyErr.Error()
+		} else if err = server.validateGroup(msg); err != nil {
 			// User is either not in the group or the group doesn't exist
-			if !ok {
-				response.Msg = fmt.Sprintf("Group %s doesn't exist.", msg.To)
-			} else {
-				response.Msg = fmt.Sprintf("You don't have access to group %s!", msg.To)
-			}
+			response.Msg = err.Error()
+		} else if server.frozenFor(msg.User, msg.To) {
+			// Only the owner can send messages to a frozen group
+			response.Msg = fmt.Sprintf("The group %s is frozen, only its owner can send messages.", msg.To)
+		} else if wait := server.muteRemaining(msg.User, msg.To); wait > 0 {
+			// User was muted in the group
+			response.Msg = fmt.Sprintf("You are muted in %s for %d more seconds.", msg.To, int(math.Ceil(wait.Seconds())))
+		} else if wait := server.slowModeRemaining(msg.User, msg.To); wait > 0 {
+			// User sent a message to the group too recently
+			response.Msg = fmt.Sprintf("Slow mode is on in %s, please wait %d seconds before sending another message.", msg.To, int(math.Ceil(wait.Seconds())))
+		} else if _, err = server.postGroupMsg(msg); err != nil {
+			// The group was deleted since we checked
+			response.Msg = err.Error()
+		} else {
+			// Build the response message for the user, with the ID their message was given
+			response.Msg = fmt.Sprintf("%s %s: %s", server.groupPrefix(msg.To), server.displayName(msg.User), msg.Msg)
+			response.ID = msg.ID
 		}
 		// Send the response back to the user
 		err = server.SendMsg(response, response.User)
+		// Let the bot answer the message if it's a command for it, after the user has their copy
+		// and subscribers have been sent the message it's answering
+		if response.ID != "" {
+			publish()
+			server.runBots(msg)
+		}
+		
+	case "ack":
+		// User received a group message, so mark it delivered to them
+		// NOTE: The ID of the message will be in msg.ID
+		if ok := server.History.Ack(msg.ID, msg.User); !ok {
+			fmt.Printf("Unexpected ack of message %s from user %s.\n", msg.ID, msg.User)
+		}
+		
+	case "delivery":
+		// User wants to know how many members haven't received a group message yet
+		// NOTE: The ID of the message will be in msg.To
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateDelivery(msg); err != nil {
+			response.Msg = err.Error()
+		} else if count, ok := server.History.Undelivered(msg.To); !ok {
+			// The message was dropped from the history since we checked
+			response.Msg = fmt.Sprintf("Message %s isn't in the history.", msg.To)
+		} else if count == 0 {
+			response.Msg = fmt.Sprintf("Message %s has reached every member.", msg.To)
+		} else {
+			response.Msg = fmt.Sprintf("Message %s hasn't reached %d %s yet.", msg.To, count, members(count))
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "unread":
+		// User wants to know how many messages they haven't seen in each of their groups
+		// NOTE: The response's msg will be empty if they've seen everything
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Msg = server.unreadSummary(msg.User)
+		// Send the response message
+		err = server.SendMsg(response, response.User)
 		
 	case "leave":
 		// User wants to leave a group
 		response := &gochat.Msg{}
 		*response = *msg
 		response.Cmd = ""
-		// Check if we are able to remove the user from the group
-		if ok := groups.RemoveUser(msg.To, msg.User); ok {
+		// Check the user can leave the group and if we were able to remove them
+		if err = server.validateLeave(msg); err != nil {
+			response.Msg = err.Error()
+		} else if ok := groups.RemoveUser(msg.To, msg.User); ok {
+			server.left(msg.User, msg.To)
 			// User was in the group, build their response message
 			response.Msg = fmt.Sprintf("You have left the group %s.", msg.To)
 			response.Cmd = "leave"
-			// Notify all other users in the group the user has left
-			msg.Msg = fmt.Sprintf("%s has left the group.", msg.User)
-			errCh := make(chan error)
-			go server.SendGroupMsg(msg, errCh)
-			// Check for errors
-			for {
-				if err, ok = <- errCh; ok {
-					fmt.Println("Group message error:", err)
-				} else {
-					break
-				}
-			}
 		} else {
-			// Group doesn't exist
+			// The group was deleted or the user left since we checked
 			response.Msg = fmt.Sprintf("Group %s doesn't exist.", msg.To)
 		}
 		// Send the response message
 		err = server.SendMsg(response, response.User)
 		
+	case "move":
+		// User wants to leave one group and join another at once
+		// NOTE: The group to join will be in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateMove(msg); err != nil {
+			response.Msg = err.Error()
+		} else if _, err := groups.MoveUser(msg.To, msg.Msg, msg.User); err != nil {
+			response.Msg = err.Error()
+		} else {
+			// Tell the user they left the first group so they update their cache
+			server.left(msg.User, msg.To)
+			response.Msg = fmt.Sprintf("You have left the group %s.", msg.To)
+			response.Cmd = "leave"
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		if response.Cmd == "leave" && err == nil {
+			// Then welcome them to the group they moved to like any join
+			err = server.joined(msg.User, msg.Msg)
+		}
+		
 	case "create":
 		// User wants to create a group
 		response := &gochat.Msg{}
 		*response = *msg
 		response.Cmd = ""
 		// Check if they were able to create the group, with themselves as owner
-		if ok := groups.Create(msg.To, msg.User); ok {
+		if err = server.validateCreate(msg); err != nil {
+			response.Msg = err.Error()
+		} else if ok := groups.Create(msg.To, msg.User); ok {
 			// Group was created, add the user to the group and build their response message
 			groups.AddUser(msg.To, msg.User)
+			server.History.MarkAllSeen(msg.User, msg.To)
+			server.Hooks.groupCreated(msg.To, msg.User)
+			server.Hooks.userJoined(msg.User, msg.To)
 			response.Msg = fmt.Sprintf("You created the group %s!", msg.To)
 			response.Cmd = "create"
 		} else {
-			// Group already exists on the server
+			// Group was created by someone else since we checked
 			response.Msg = fmt.Sprintf("Group %s already exists!", msg.To)
 		}
 		// Send the response message
@@ -261,158 +870,1504 @@ func (server *Server) HandleRequest(conn net.Conn) {
 		response := &gochat.Msg{}
 		*response = *msg
 		response.Cmd = ""
-		// Check if the group exists
-		if group, ok := groups.Get(msg.To); ok {
-			// Check if the user is the owner of the group
-			if group.Owner == msg.User {
-				response.Msg = fmt.Sprintf("You deleted the group %s!", msg.To)
-				response.Cmd = "delete"
-				// Notify all other users in the group
-				msg.Msg = "has been deleted."
-				errCh := make(chan error)
-				go server.SendGroupMsg(msg, errCh)
-				// Check for errors
-				for {
-					if err, ok = <- errCh; ok {
-						fmt.Println("Group message error:", err)
-					} else {
-						break
-					}
+		// Check if the group exists and the user is the owner of the group
+		if err = server.validateDelete(msg); err == nil {
+			response.Msg = fmt.Sprintf("You deleted the group %s!", msg.To)
+			response.Cmd = "delete"
+			// Notify all other users in the group
+			msg.Msg = "has been deleted."
+			errCh := make(chan error)
+			go server.SendGroupMsg(msg, errCh)
+			// Check for errors
+			for {
+				if err, ok := <- errCh; ok {
+					fmt.Println("Group message error:", err)
+				} else {
+					break
 				}
-				// delete the group
-				groups.Delete(msg.To)
-			} else {
-				// User is not the owner of the group
-				response.Msg = fmt.Sprintf("You don't have permission to delete the group %s!", msg.To)
 			}
+			// delete the group
+			groups.Delete(msg.To)
+			server.Invites.RemoveGroup(msg.To)
 		} else {
-			// Group user wants to delete doesn't exist
-			response.Msg = fmt.Sprintf("Group %s doesn't exist!", msg.To)
+			// Group doesn't exist or user is not the owner of the group
+			response.Msg = err.Error()
 		}
 		// Send the response message
 		err = server.SendMsg(response, response.User)
 		
-	case "disconnect":
-		// User has disconnected from the server
-		fmt.Printf("Received a d/c from user %s!\n", msg.User)
-		// Remove the user from the AddrMap
-		if ok := addrs.Remove(msg.User); ok {
-			// Remove user from all groups they're in
-			for _, groupName := range groups.GroupNames() {
-				if _, contains := groups.ContainsUser(groupName, msg.User); contains {
-					// Remove the user from the group
-					groups.RemoveUser(groupName, msg.User)
-					// Notify all users in the group that the user has left
-					msg.Msg = fmt.Sprintf("%s has left the group.", msg.User)
-					msg.To = groupName
-					msg.Cmd = "leave"
-					errCh := make(chan error)
-					go server.SendGroupMsg(msg, errCh)
-					// Check for errors
-					for {
-						if err, ok = <- errCh; ok {
-							fmt.Println("Group message error:", err)
-						} else {
-							break
-						}
-					}
-				}
-			}
-		} else {
-			fmt.Printf("User %s doesn't exist!\n", msg.User)
-		}
-	case "kick":
-		// User wants to kick someone from a group
-		// NOTE: The user to remove will be in msg.Msg
+	case "rename":
+		// User wants to rename a group
+		// NOTE: The new group name will be in msg.Msg
 		response := &gochat.Msg{}
 		*response = *msg
 		response.Cmd = ""
-		// Check if the group exists
-		if group, ok := groups.Get(msg.To); ok {
-			// Check if the user is the owner of the group
-			if group.Owner == msg.User {
-				// Remove the target user from the group (given by msg.Msg)
-				if ok = groups.RemoveUser(msg.To, msg.Msg); ok {
-					response.Msg = "" // to denote we don't want to send a response
-					// Notify all other users in the group who was kicked (kicked user is no longer in group)
-					kickedMsg := &gochat.Msg{}
-					*kickedMsg = *msg //shallow copy msg
-					kickedMsg.User = msg.Msg
-					kickedMsg.Msg = fmt.Sprintf("%s has been kicked from the group.", msg.Msg)
-					errCh := make(chan error)
-					go server.SendGroupMsg(kickedMsg, errCh)
-					// Check for errors
-					for {
-						if err, ok = <- errCh; ok {
-							fmt.Println("Group message error:", err)
-						} else {
-							break
-						}
-					}
-					// Notify the kicked user with a separate message
-					kickedUserMsg := &gochat.Msg{}
-					kickedUserMsg.User = msg.Msg
-					kickedUserMsg.To = msg.To
-					kickedUserMsg.Msg = fmt.Sprintf("[%s] You've been removed from the group.", kickedUserMsg.To)
-					kickedUserMsg.Cmd = "leave"
-					server.SendMsg(kickedUserMsg, msg.Msg)
-				} else {
-					// Target user is not in the group
-					response.Msg = fmt.Sprintf("User %s isn't in the group %s.", msg.Msg, msg.To)
+		// Check the group can be renamed by the user
+		if err = server.validateRename(msg); err != nil {
+			response.Msg = err.Error()
+		} else if group, ok := groups.Get(msg.To); ok && groups.Rename(msg.To, msg.Msg) {
+			server.History.RenameGroup(msg.To, msg.Msg)
+			server.Invites.RenameGroup(msg.To, msg.Msg)
+			response.Msg = "" // to denote we don't want to send a response
+			// Notify all users in the group, including the owner, so they can update
+			// their local cache to the new name
+			renameMsg := &gochat.Msg{}
+			*renameMsg = *msg
+			for _, groupMember := range group.Users.Array() {
+				if err = server.SendMsg(renameMsg, groupMember); err != nil {
+					fmt.Println("Rename message error:", err)
 				}
-				
-			} else {
-				// User is not the owner of the group
-				response.Msg = fmt.Sprintf("You don't have permission to remove users from group %s!", msg.To)
 			}
 		} else {
-			// The group doesn't exist on the server
-			response.Msg = fmt.Sprintf("Group %s doesn't exist!", msg.To)
+			// The group was deleted or a group with the new name was created since we checked
+			response.Msg = fmt.Sprintf("Group %s couldn't be renamed to %s!", msg.To, msg.Msg)
 		}
 		// Send the response message if there was an error
 		if response.Msg != "" {
 			err = server.SendMsg(response, response.User)
 		}
-	} // end switch
-}
-
-// Wrapper to send a message. Checks if the user has an address
-func (server *Server) SendMsg(msg *gochat.Msg, user string)  (err error) {
-	if addr, ok := server.Addrs.Get(user); ok {
-		return msg.Send(addr.String())
-	} else {
-		return errors.New(fmt.Sprintf("Address for user %s not found.", user))
-	}
-}
-
-// Wrapper to send a message to all users of a group
-func (server *Server) SendGroupMsg(msg *gochat.Msg, c chan error)  {
-	if group, ok := server.Groups.Get(msg.To); ok {
-		for _, user := range group.Users.Array() {
-			// Don't send the message to the user who wanted it sent
-			if user != msg.User {
-				// Check if we have an address for the user
-				if addr, ok := server.Addrs.Get(user); ok {
-					//shallow copy
-					response := *msg
-					response.Msg = fmt.Sprintf("[%s] %s", msg.To, msg.Msg)
-					// send the message
-					err := response.Send(addr.String())
-					if err != nil {
-						// send the error to the channel if we encounter one
-						c <- err
-					}
-				} else {
-					// send the error to the channel if we encounter one
-					c <- errors.New(fmt.Sprintf("Could not find address for user %s.", user))
-					continue
-				}
+		
+	case "list":
+		// User wants to know what groups are on the server
+		// NOTE: An optional pattern to filter the group names with will be in msg.To
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if infos, err := matchGroups(groups.GroupInfos(), msg.To); err != nil {
+			// The pattern couldn't be parsed
+			response.Msg = fmt.Sprintf("Invalid pattern %s: %s", msg.To, err)
+		} else if len(infos) > 0 {
+			// Build a list of the matching groups
+			response.Msg = "Groups:"
+			for _, info := range infos {
+				response.Msg += fmt.Sprintf("\n * %s", describeGroup(info))
 			}
+		} else {
+			response.Msg = fmt.Sprintf("No groups match %s.", msg.To)
 		}
-	} else {
-		// send the error to the channel if we encounter one
-		c <- errors.New(fmt.Sprintf("Group %s doesn't exist.", msg.To))
-	}
-	// close the channel so the HandleRequest goroutine can continue
-	close(c)
-}
\ No newline at end of file
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "peer":
+		// A server is federating with us
+		if err = server.handlePeer(msg); err != nil {
+			fmt.Println("Peer handshake error:", err)
+		}
+		
+	case "peerUser":
+		// A user connected to or disconnected from a peer
+		if err = server.handlePeerUser(msg); err != nil {
+			fmt.Println("Peer update error:", err)
+		}
+		
+	case "federate":
+		// A peer relayed a group message to deliver to our members of the group
+		errCh := make(chan error)
+		go server.handleFederate(msg, errCh)
+		for err := range errCh {
+			fmt.Println("Group message error:", err)
+		}
+		
+	case "owner":
+		// User wants to know who owns a group
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if owner, ok := groups.Owner(msg.To); !ok {
+			response.Msg = fmt.Sprintf("Group %s doesn't exist.", msg.To)
+		} else if owner == "" {
+			// The global group is created by the server rather than a user
+			response.Msg = fmt.Sprintf("Group %s has no owner.", msg.To)
+		} else {
+			response.Msg = fmt.Sprintf("Group %s is owned by %s.", msg.To, owner)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "announceowned":
+		// User wants to send a message to every group they own
+		// NOTE: The message will be split across msg.To and msg.Msg, as it has no target
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		text := strings.TrimSpace(fmt.Sprintf("%s %s", msg.To, msg.Msg))
+		groupNames := groups.OwnedBy(msg.User)
+		sort.Strings(groupNames)
+		if text == "" {
+			response.Msg = "Please enter a message to announce."
+		} else if len(groupNames) == 0 {
+			response.Msg = "You don't own any groups."
+		} else {
+			// Send it to each group as a group message, reporting how it went in each
+			response.Msg = "Announced to the groups you own:"
+			for _, groupName := range groupNames {
+				announcement := &gochat.Msg{User: msg.User, To: groupName, Msg: text, Cmd: "group"}
+				// The group may have been deleted or handed over since we looked it up
+				if err := server.validateGroup(announcement); err != nil {
+					response.Msg += fmt.Sprintf("\n * %s: skipped. %s", groupName, err)
+				} else if owner, _ := groups.Owner(groupName); owner != msg.User {
+					response.Msg += fmt.Sprintf("\n * %s: skipped. You no longer own it.", groupName)
+				} else if failed, err := server.postGroupMsg(announcement); err != nil {
+					response.Msg += fmt.Sprintf("\n * %s: skipped. %s", groupName, err)
+				} else if failed > 0 {
+					response.Msg += fmt.Sprintf("\n * %s: couldn't reach %d %s", groupName, failed, members(failed))
+				} else {
+					response.Msg += fmt.Sprintf("\n * %s: delivered", groupName)
+				}
+			}
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "diff":
+		// User wants the group's members so they can check their cache against them
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateGroup(msg); err != nil {
+			response.Msg = err.Error()
+		} else if group, ok := groups.Get(msg.To); ok {
+			// Send back the members for the client to compare
+			response.Msg = strings.Join(group.Users.SortedArray(), " ")
+			response.Cmd = "diff"
+		} else {
+			// The group was deleted since we checked
+			response.Msg = fmt.Sprintf("Group %s doesn't exist.", msg.To)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "owned":
+		// User wants to know what groups they own
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if groupNames := groups.OwnedBy(msg.User); len(groupNames) > 0 {
+			sort.Strings(groupNames)
+			// Build a list of the groups
+			response.Msg = "Groups you own:"
+			for _, groupName := range groupNames {
+				response.Msg += fmt.Sprintf("\n * %s", groupName)
+			}
+		} else {
+			response.Msg = "You don't own any groups."
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "mod":
+		// User wants to make someone a moderator of a group
+		// NOTE: The user to promote will be in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		// Check the user can promote the target user in the group
+		if err = server.validateMod(msg); err != nil {
+			response.Msg = err.Error()
+		} else if ok := groups.AddModerator(msg.To, msg.Msg); ok {
+			response.Msg = fmt.Sprintf("You made %s a moderator of the group %s.", msg.Msg, msg.To)
+			// Notify the promoted user
+			modMsg := &gochat.Msg{}
+			modMsg.User = msg.Msg
+			modMsg.To = msg.To
+			modMsg.Msg = fmt.Sprintf("%s You are now a moderator of the group.", server.groupPrefix(msg.To))
+			modMsg.Cmd = "mod"
+			server.SendMsg(modMsg, msg.Msg)
+		} else {
+			// The group or target user's membership changed since we checked
+			response.Msg = fmt.Sprintf("User %s couldn't be made a moderator of the group %s.", msg.Msg, msg.To)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "display":
+		// User wants to change the name they're shown by
+		// NOTE: The new display name will be in msg.To
+		response := &gochat.Msg{}
+		*response = *msg
+		if err = server.validateDisplay(msg); err != nil {
+			response.Cmd = ""
+			response.Msg = err.Error()
+		} else if !server.setDisplayName(msg.User, msg.To) {
+			// Another user took the name since we checked
+			response.Cmd = ""
+			response.Msg = fmt.Sprintf("The name %s is already used by another user.", msg.To)
+		} else {
+			response.Msg = fmt.Sprintf("You will now be shown as %s.", msg.To)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "friend", "unfriend":
+		// User wants to add or remove a friend
+		// NOTE: The friend will be in msg.To
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if target, err := server.validateFriend(msg); err != nil {
+			response.Msg = err.Error()
+		} else if msg.Cmd == "friend" {
+			if server.addFriend(msg.User, target) {
+				response.Msg = fmt.Sprintf("You added %s as a friend.", target)
+			} else {
+				response.Msg = fmt.Sprintf("User %s is already one of your friends.", target)
+			}
+		} else if server.removeFriend(msg.User, target) {
+			response.Msg = fmt.Sprintf("You removed %s as a friend.", target)
+		} else {
+			response.Msg = fmt.Sprintf("User %s isn't one of your friends.", target)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "invite":
+		// User wants to invite one or more users to a group
+		// NOTE: The users to invite will be in msg.Msg, separated by commas
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		names := inviteNames(msg.Msg)
+		if err = server.validateGroup(msg); err != nil {
+			response.Msg = err.Error()
+		} else if len(names) == 0 {
+			response.Msg = "Please enter the user to invite."
+		} else if len(names) == 1 {
+			if target, err := server.invite(msg.User, msg.To, names[0]); err != nil {
+				response.Msg = err.Error()
+			} else {
+				response.Msg = fmt.Sprintf("You invited %s to the group %s.", target, msg.To)
+			}
+		} else {
+			// Invite each user, reporting who was invited and why the rest weren't
+			var invited, failed []string
+			for _, name := range names {
+				if target, err := server.invite(msg.User, msg.To, name); err != nil {
+					failed = append(failed, fmt.Sprintf("\n * %s: %s", name, err))
+				} else {
+					invited = append(invited, target)
+				}
+			}
+			if len(invited) > 0 {
+				response.Msg = fmt.Sprintf("You invited %s to the group %s.", strings.Join(invited, ", "), msg.To)
+			} else {
+				response.Msg = fmt.Sprintf("No one was invited to the group %s.", msg.To)
+			}
+			if len(failed) > 0 {
+				response.Msg += "\nCouldn't invite:" + strings.Join(failed, "")
+			}
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "promote":
+		// User wants to move their direct messages with someone into a new group of the two of them
+		// NOTE: The user to add will be in msg.To, and the name of the group in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		response.To = msg.Msg
+		if target, err := server.validatePromote(msg); err != nil {
+			response.Msg = err.Error()
+			err = server.SendMsg(response, response.User)
+		} else if ok := groups.Create(msg.Msg, msg.User); !ok {
+			// Group was created by someone else since we checked
+			response.Msg = fmt.Sprintf("Group %s already exists!", msg.Msg)
+			err = server.SendMsg(response, response.User)
+		} else {
+			// Group was created, add the user to it as its owner
+			groups.AddUser(msg.Msg, msg.User)
+			server.History.MarkAllSeen(msg.User, msg.Msg)
+			server.Hooks.groupCreated(msg.Msg, msg.User)
+			server.Hooks.userJoined(msg.User, msg.Msg)
+			response.Msg = fmt.Sprintf("You created the group %s with %s!", msg.Msg, target)
+			response.Cmd = "create"
+			err = server.SendMsg(response, response.User)
+			// Let the target user know why they're in a new group, then add them to it
+			notice := &gochat.Msg{User: msg.User, To: msg.Msg}
+			notice.Msg = fmt.Sprintf("%s %s moved your conversation into this group.", server.groupPrefix(msg.Msg), server.displayName(msg.User))
+			server.SendMsg(notice, target)
+			groups.AddUser(msg.Msg, target)
+			server.joined(target, msg.Msg)
+		}
+		
+	case "invites":
+		// User wants to know what groups they've been invited to
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if groupNames := server.Invites.Pending(msg.User); len(groupNames) > 0 {
+			response.Msg = "Invites:"
+			for _, groupName := range groupNames {
+				response.Msg += fmt.Sprintf("\n * %s", groupName)
+			}
+		} else {
+			response.Msg = "You have no pending invites."
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "pin", "unpin":
+		// User wants to pin a message in a group, or remove the one pinned
+		// NOTE: The message to pin will be in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if msg.Cmd == "unpin" {
+			msg.Msg = ""
+		}
+		if err = server.validatePin(msg); err != nil {
+			response.Msg = err.Error()
+			err = server.SendMsg(response, response.User)
+		} else if ok := groups.SetPin(msg.To, msg.Msg); ok {
+			// Notify everyone in the group, including the user, so they can update their cache
+			errCh := make(chan error)
+			go server.SendGroupMsg(msg, errCh)
+			// Check for errors
+			for err := range errCh {
+				fmt.Println("Group message error:", err)
+			}
+			err = server.SendMsg(msg, msg.User)
+		} else {
+			// The group was deleted since we checked
+			response.Msg = fmt.Sprintf("Group %s doesn't exist!", msg.To)
+			err = server.SendMsg(response, response.User)
+		}
+		
+	case "afk", "back":
+		// User wants to stop being sent a group's messages for a while without leaving it, or
+		// to start being sent them again
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateAway(msg); err != nil {
+			response.Msg = err.Error()
+		} else if ok := groups.SetAway(msg.To, msg.User, msg.Cmd == "afk"); !ok {
+			// User left the group, or already changed whether they're away, since we checked
+			response.Msg = fmt.Sprintf("Couldn't %s the group %s, please try again.", msg.Cmd, msg.To)
+		} else if msg.Cmd == "afk" {
+			response.Msg = fmt.Sprintf("%s You're away, its messages won't be sent to you until you enter back %s.", server.groupPrefix(msg.To), msg.To)
+		} else {
+			missed := server.History.Unseen(msg.User, msg.To)
+			response.Msg = fmt.Sprintf("%s Welcome back, you missed %d %s.", server.groupPrefix(msg.To), len(missed), messages(len(missed)))
+			if server.ReplayMissed {
+				// Include what they missed as it was sent to the rest of the group, in one
+				// message so it's shown in order, and count it as delivered
+				for i := range missed {
+					response.Msg += fmt.Sprintf("\n%s %s", server.groupPrefix(msg.To), server.groupText(&missed[i]))
+					server.History.Ack(missed[i].ID, msg.User)
+				}
+			}
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "pinned":
+		// User wants to know what message is pinned in a group
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateGroup(msg); err != nil {
+			response.Msg = err.Error()
+		} else if pinned, _ := groups.Pin(msg.To); pinned != "" {
+			response.Msg = fmt.Sprintf("%s Pinned: %s", server.groupPrefix(msg.To), pinned)
+		} else {
+			response.Msg = fmt.Sprintf("No message is pinned in the group %s.", msg.To)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "activity":
+		// User wants to know how busy a group has been lately
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateGroup(msg); err != nil {
+			response.Msg = err.Error()
+		} else {
+			response.Msg = fmt.Sprintf("%s Activity:", server.groupPrefix(msg.To))
+			now := time.Now()
+			for _, window := range activityWindows {
+				count, complete := server.History.CountSince(msg.To, now.Add(-window.Duration))
+				// Older messages were dropped from the history, so there may have been more
+				more := ""
+				if !complete {
+					more = "+"
+				}
+				response.Msg += fmt.Sprintf("\n * %d%s %s in the last %s", count, more, messages(count), window.Name)
+			}
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "tempmute":
+		// User wants to stop someone sending messages to a group for a while
+		// NOTE: The user to mute and how many seconds to mute them for will be in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if target, duration, err := server.validateTempMute(msg); err != nil {
+			response.Msg = err.Error()
+		} else {
+			server.mute(target, msg.To, duration)
+			seconds := int(duration.Seconds())
+			response.Msg = fmt.Sprintf("You muted %s in the group %s for %d seconds.", target, msg.To, seconds)
+			// Let the muted user know
+			muteMsg := &gochat.Msg{User: msg.User, To: msg.To, Cmd: "tempmute"}
+			muteMsg.Msg = fmt.Sprintf("%s You have been muted for %d seconds.", server.groupPrefix(msg.To), seconds)
+			server.SendMsg(muteMsg, target)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "limit":
+		// User wants to limit how many members a group can have
+		// NOTE: The limit will be in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if limit, err := server.validateLimit(msg); err != nil {
+			response.Msg = err.Error()
+		} else if ok := groups.SetLimit(msg.To, limit); !ok {
+			// The group was deleted since we checked
+			response.Msg = fmt.Sprintf("Group %s doesn't exist!", msg.To)
+		} else if limit == 0 {
+			response.Msg = fmt.Sprintf("The group %s no longer has a member limit.", msg.To)
+		} else {
+			response.Msg = fmt.Sprintf("The group %s can now have up to %d %s.", msg.To, limit, members(limit))
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "slowmode":
+		// User wants to limit how often members can send messages to a group
+		// NOTE: The interval in seconds will be in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if interval, err := server.validateSlowMode(msg); err != nil {
+			response.Msg = err.Error()
+		} else if ok := groups.SetSlowMode(msg.To, interval); !ok {
+			// The group was deleted since we checked
+			response.Msg = fmt.Sprintf("Group %s doesn't exist!", msg.To)
+		} else if interval == 0 {
+			response.Msg = fmt.Sprintf("Slow mode is now off in the group %s.", msg.To)
+		} else {
+			response.Msg = fmt.Sprintf("Members of the group %s can now send a message every %d seconds.", msg.To, int(interval.Seconds()))
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "freeze", "unfreeze":
+		// User wants to stop everyone but themselves sending messages to a group they own, or
+		// let them again
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		frozen := msg.Cmd == "freeze"
+		if err = server.validateOwner(msg); err != nil {
+			response.Msg = err.Error()
+		} else if ok := groups.SetFrozen(msg.To, frozen); !ok {
+			// The group was deleted since we checked
+			response.Msg = fmt.Sprintf("Group %s doesn't exist!", msg.To)
+		} else {
+			// Let the other members know why their messages are or aren't rejected
+			notice := &gochat.Msg{}
+			*notice = *msg
+			if frozen {
+				notice.Msg = "The group was frozen, only its owner can send messages."
+				response.Msg = fmt.Sprintf("You froze the group %s.", msg.To)
+			} else {
+				notice.Msg = "The group was unfrozen."
+				response.Msg = fmt.Sprintf("You unfroze the group %s.", msg.To)
+			}
+			errCh := make(chan error)
+			go server.SendGroupMsg(notice, errCh)
+			// Check for errors
+			for err := range errCh {
+				fmt.Println("Group message error:", err)
+			}
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "clear":
+		// User wants to wipe the history of a group they own
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateOwner(msg); err != nil {
+			response.Msg = err.Error()
+		} else {
+			removed := server.History.Clear(msg.To)
+			response.Msg = fmt.Sprintf("%s You cleared %d %s from the group's history.", server.groupPrefix(msg.To), removed, messages(removed))
+			response.Cmd = "clear"
+			// Let the other members know so they can clear what they've been shown too
+			notice := &gochat.Msg{User: msg.User, To: msg.To, Msg: "The group's history was cleared by its owner.", Cmd: "clear"}
+			errCh := make(chan error)
+			go server.SendGroupMsg(notice, errCh)
+			// Check for errors
+			for err := range errCh {
+				fmt.Println("Group message error:", err)
+			}
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "usergroups":
+		// Admin wants to know what groups a user is in
+		// NOTE: The user to look up will be in msg.To
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateAdmin(msg); err != nil {
+			response.Msg = err.Error()
+		} else if groupNames := server.userGroups(msg.To); len(groupNames) > 0 {
+			// Build a list of the user's groups
+			response.Msg = fmt.Sprintf("Groups of %s:", msg.To)
+			for _, groupName := range groupNames {
+				response.Msg += fmt.Sprintf("\n * %s", groupName)
+			}
+		} else {
+			response.Msg = fmt.Sprintf("User %s isn't in any groups.", msg.To)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "addr":
+		// Admin wants to know where the server sends a user's messages, such as to check the
+		// port it recorded when they connected is the one they're listening on
+		// NOTE: The user to look up will be in msg.To
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateAdmin(msg); err != nil {
+			response.Msg = err.Error()
+		} else if userAddrs := addrs.All(msg.To); len(userAddrs) > 0 {
+			// List the address of each device the user is connected from, most recent last
+			lines := make([]string, len(userAddrs))
+			for i := range userAddrs {
+				lines[i] = userAddrs[i].String()
+			}
+			response.Msg = strings.Join(lines, "\n")
+		} else {
+			response.Msg = fmt.Sprintf("User %s isn't online.", msg.To)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "topgroups":
+		// Admin wants to know which groups have the most members
+		// NOTE: How many groups to list will be in msg.To
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if n, err := server.validateTopGroups(msg); err != nil {
+			response.Msg = err.Error()
+		} else if largest := server.largestGroups(n); len(largest) > 0 {
+			// Build a list of the largest groups
+			response.Msg = "Largest groups:"
+			for _, group := range largest {
+				response.Msg += fmt.Sprintf("\n * %s (%d %s)", group.Name, group.Members, members(group.Members))
+			}
+		} else {
+			response.Msg = "There are no groups."
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "report":
+		// User wants to report another user's messages to the admins
+		// NOTE: The reason will be in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if target, err := server.validateReport(msg); err != nil {
+			response.Msg = err.Error()
+		} else {
+			// Note which groups they share, so admins know where to look
+			var shared []string
+			for _, groupName := range server.userGroups(msg.User) {
+				if contains, _ := groups.ContainsUser(groupName, target); contains {
+					shared = append(shared, groupName)
+				}
+			}
+			report := Report{Reporter: msg.User, Target: target, Reason: msg.Msg, Groups: shared, Time: time.Now()}
+			server.Reports.Add(report)
+			if server.NotifyReports {
+				for _, admin := range server.Admins.Array() {
+					if admin != msg.User && server.Addrs.Online(admin) {
+						notice := &gochat.Msg{User: msg.User, To: admin, Msg: fmt.Sprintf("New report: %s", formatReport(report))}
+						server.SendMsg(notice, admin)
+					}
+				}
+			}
+			response.Msg = fmt.Sprintf("Your report about %s was sent to the admins.", target)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "reports":
+		// Admin wants to see the reports users have made
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateAdmin(msg); err != nil {
+			response.Msg = err.Error()
+		} else if reports := server.Reports.All(); len(reports) > 0 {
+			// Build a list of the reports
+			response.Msg = "Reports:"
+			for _, report := range reports {
+				response.Msg += fmt.Sprintf("\n * %s", formatReport(report))
+			}
+		} else {
+			response.Msg = "No reports have been made."
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "allusers":
+		// Admin wants to know every user who has ever connected, online or not
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if err = server.validateAdmin(msg); err != nil {
+			response.Msg = err.Error()
+		} else {
+			users := server.SeenUsers.SortedArray()
+			response.Msg = fmt.Sprintf("%d users have connected to the server:", len(users))
+			for _, user := range users {
+				response.Msg += fmt.Sprintf("\n * %s", user)
+			}
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "recent":
+		// Admin wants to know who disconnected most recently
+		// NOTE: How many disconnects to list will be in msg.To
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		if n, err := server.validateRecent(msg); err != nil {
+			response.Msg = err.Error()
+		} else if disconnects := server.Disconnects.Last(n); len(disconnects) > 0 {
+			// Build a list of the disconnects
+			response.Msg = "Recently disconnected:"
+			for _, disconnect := range disconnects {
+				response.Msg += fmt.Sprintf("\n * %s at %s", disconnect.User, disconnect.Time.Format("2006-01-02 15:04:05"))
+			}
+		} else {
+			response.Msg = "No one has disconnected."
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "help":
+		// User wants to know what commands they can use
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		response.Msg = server.help()
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "validate":
+		// User wants to know if a command would succeed, without running it
+		// NOTE: The command to check will be in msg.To, and its arguments in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		target := &gochat.Msg{User: msg.User, Cmd: msg.To}
+		args := gochat.SplitArgs(msg.Msg, 2)
+		if len(args) > 0 {
+			target.To = args[0]
+		}
+		if len(args) > 1 {
+			target.Msg = args[1]
+		}
+		command := strings.TrimSpace(fmt.Sprintf("%s %s", msg.To, msg.Msg))
+		if err = server.Validate(target); err != nil {
+			response.Msg = fmt.Sprintf("%s would fail: %s", command, err)
+		} else {
+			response.Msg = fmt.Sprintf("%s would succeed.", command)
+		}
+		// Send the response message
+		err = server.SendMsg(response, response.User)
+		
+	case "disconnect":
+		// User has disconnected from the server
+		// NOTE: The port the disconnecting device was listening on will be in msg.Msg, or
+		//       empty to disconnect all of the user's devices
+		fmt.Printf("Received a d/c from user %s!\n", msg.User)
+		if msg.Msg == "" {
+			if addrs.Remove(msg.User) {
+				server.goOffline(msg.User)
+			}
+			break
+		}
+		addr, err := listenAddr(conn, msg.Msg)
+		if err != nil {
+			fmt.Printf("Invalid disconnect from user %s: %s\n", msg.User, err)
+			break
+		}
+		// Only remove the disconnecting device. A disconnect for a device the user doesn't
+		// have, such as a stale or spoofed one, leaves all their others connected
+		removed, last := addrs.RemoveAddr(msg.User, addr)
+		if !removed {
+			fmt.Printf("User %s has no device at %s!\n", msg.User, addr.String())
+		} else if !last {
+			fmt.Printf("User %s is still connected from another device.\n", msg.User)
+		} else {
+			server.goOffline(msg.User)
+		}
+	case "kick":
+		// User wants to kick someone from a group
+		// NOTE: The user to remove will be in msg.Msg
+		response := &gochat.Msg{}
+		*response = *msg
+		response.Cmd = ""
+		// Check the user can remove the target user (given by msg.Msg) from the group
+		if target, err := server.validateKick(msg); err != nil {
+			response.Msg = err.Error()
+		} else if ok := groups.RemoveUser(msg.To, target); ok {
+			// Remove the target user from the group
+			msg.Msg = target
+			server.Hooks.userLeft(target, msg.To)
+			response.Msg = "" // to denote we don't want to send a response
+			// Notify all other users in the group who was kicked (kicked user is no longer in group)
+			kickedMsg := &gochat.Msg{}
+			*kickedMsg = *msg //shallow copy msg
+			kickedMsg.User = msg.Msg
+			kickedMsg.Msg = fmt.Sprintf(server.Greetings.Kicked, server.displayName(msg.Msg))
+			errCh := make(chan error)
+			go server.SendGroupMsg(kickedMsg, errCh)
+			// Check for errors
+			for {
+				if err, ok = <- errCh; ok {
+					fmt.Println("Group message error:", err)
+				} else {
+					break
+				}
+			}
+			// Notify the kicked user with a separate message
+			kickedUserMsg := &gochat.Msg{}
+			kickedUserMsg.User = msg.Msg
+			kickedUserMsg.To = msg.To
+			kickedUserMsg.Msg = fmt.Sprintf("%s You've been removed from the group.", server.groupPrefix(kickedUserMsg.To))
+			kickedUserMsg.Cmd = "leave"
+			server.SendMsg(kickedUserMsg, msg.Msg)
+		} else {
+			// Target user left the group since we checked
+			response.Msg = fmt.Sprintf("User %s isn't in the group %s.", target, msg.To)
+		}
+		// Send the response message if there was an error
+		if response.Msg != "" {
+			err = server.SendMsg(response, response.User)
+		}
+	} // end switch
+}
+
+// Calls the OnUserJoin hook if it's set
+func (hooks *Hooks) userJoined(user, group string) {
+	if hooks.OnUserJoin != nil {
+		hooks.OnUserJoin(user, group)
+	}
+}
+
+// Calls the OnUserLeave hook if it's set
+func (hooks *Hooks) userLeft(user, group string) {
+	if hooks.OnUserLeave != nil {
+		hooks.OnUserLeave(user, group)
+	}
+}
+
+// Calls the OnMessage hook if it's set with a copy of the message sent to the given recipient
+func (hooks *Hooks) message(msg *gochat.Msg, to string) {
+	if hooks.OnMessage != nil {
+		sent := *msg
+		sent.To = to
+		hooks.OnMessage(sent)
+	}
+}
+
+// Calls the OnGroupCreate hook if it's set
+func (hooks *Hooks) groupCreated(group, owner string) {
+	if hooks.OnGroupCreate != nil {
+		hooks.OnGroupCreate(group, owner)
+	}
+}
+
+// Writes the message to the Server's AuditWriter as a line of JSON, if it has one
+func (server *Server) audit(msg *gochat.Msg) {
+	if server.AuditWriter == nil {
+		return
+	}
+	entry := auditEntry{time.Now(), msg.User, msg.Cmd, msg.To, msg.Msg}
+	if preview := []rune(entry.Msg); len(preview) > auditPreviewLen {
+		entry.Msg = string(preview[:auditPreviewLen]) + "..."
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Audit encoding error:", err)
+		return
+	}
+	// Many HandleRequest goroutines write at once, so keep each line whole
+	server.auditLock.Lock()
+	_, err = server.AuditWriter.Write(append(line, '\n'))
+	server.auditLock.Unlock()
+	if err != nil {
+		fmt.Println("Audit writing error:", err)
+	}
+}
+
+// Starts a new session for the user, returning its token
+func (server *Server) startSession(user string) string {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		fmt.Println("Error generating session token:", err)
+		return ""
+	}
+	token := hex.EncodeToString(tokenBytes)
+	server.sessionLock.Lock()
+	server.sessions[user] = session{token, time.Now().Add(server.SessionTTL)}
+	server.sessionLock.Unlock()
+	return token
+}
+
+// Checks the token matches the user's unexpired session, and if so extends the session.
+// Returns false if the token doesn't match or the session has expired
+func (server *Server) renewSession(user, token string) (ok bool) {
+	server.sessionLock.Lock()
+	userSession, ok := server.sessions[user]
+	ok = ok && token != "" && userSession.token == token && time.Now().Before(userSession.expires)
+	if ok {
+		server.sessions[user] = session{token, time.Now().Add(server.SessionTTL)}
+	}
+	server.sessionLock.Unlock()
+	return
+}
+
+// Takes the user offline once their last device has been removed from the AddrMap: ends their
+// session, removes them from every group they're in, and notifies the other members
+func (server *Server) goOffline(user string) {
+	server.endSession(user)
+	// Remove user from all groups they're in at once, so they're fully gone before
+	// anyone is notified
+	groupNames := server.Groups.RemoveUserFromAll(user)
+	server.announceUser(user, "offline")
+	// Notify all users in each group that the user has left, all groups at once
+	var notices sync.WaitGroup
+	for _, groupName := range groupNames {
+		server.Hooks.userLeft(user, groupName)
+		leaveMsg := &gochat.Msg{User: user, To: groupName, Cmd: "leave"}
+		leaveMsg.Msg = fmt.Sprintf(server.Greetings.Left, server.displayName(user))
+		errCh := make(chan error)
+		if groupName == "global" {
+			// Leaving global is going offline
+			go server.sendPresence(leaveMsg, errCh)
+		} else {
+			go server.SendGroupMsg(leaveMsg, errCh)
+		}
+		notices.Add(1)
+		go func() {
+			defer notices.Done()
+			// Check for errors
+			for err := range errCh {
+				fmt.Println("Group message error:", err)
+			}
+		}()
+	}
+	// Don't return until everyone has been notified
+	notices.Wait()
+	server.Disconnects.Add(user, time.Now())
+	server.setDisplayName(user, "")
+}
+
+// Checks the message was signed with the token of the user's session
+func (server *Server) signedBy(msg *gochat.Msg, user string) bool {
+	server.sessionLock.Lock()
+	userSession, ok := server.sessions[user]
+	server.sessionLock.Unlock()
+	return ok && userSession.token != "" && msg.Verify([]byte(userSession.token))
+}
+
+// Checks the signed message was signed within SignatureMaxAge and no message with its nonce
+// has been accepted in that time, so a captured message can't be sent again. Records its nonce
+// NOTE: Only call this once the signature is verified, so forged nonces aren't recorded
+func (server *Server) fresh(msg *gochat.Msg) bool {
+	now := time.Now()
+	signedAt := time.Unix(0, msg.SignedAt)
+	if len(msg.Nonce) == 0 || now.Sub(signedAt) > server.SignatureMaxAge || signedAt.Sub(now) > server.SignatureMaxAge {
+		return false
+	}
+	server.nonceLock.Lock()
+	defer server.nonceLock.Unlock()
+	// Forget nonces of messages that would be rejected as too old by now anyway
+	if now.Sub(server.noncesPruned) > server.SignatureMaxAge {
+		for nonce, at := range server.nonces {
+			if now.Sub(at) > server.SignatureMaxAge {
+				delete(server.nonces, nonce)
+			}
+		}
+		server.noncesPruned = now
+	}
+	if _, seen := server.nonces[string(msg.Nonce)]; seen {
+		return false
+	}
+	server.nonces[string(msg.Nonce)] = signedAt
+	return true
+}
+
+// Ends the user's session so its token can no longer be used
+func (server *Server) endSession(user string) {
+	server.sessionLock.Lock()
+	delete(server.sessions, user)
+	server.sessionLock.Unlock()
+}
+
+// Returns the names of the groups the user is in, sorted.
+// This uses the GroupMap's reverse index of each user's groups, so it's O(user's groups)
+// rather than checking every group on the Server.
+func (server *Server) userGroups(user string) (groupNames []string) {
+	groupNames = server.Groups.UserGroups(user)
+	sort.Strings(groupNames)
+	return
+}
+
+// Returns the n groups with the most members, largest first. Groups of the same size are
+// sorted by name
+func (server *Server) largestGroups(n int) []gochat.GroupInfo {
+	sizes := server.Groups.GroupInfos()
+	// Already sorted by name, so a stable sort keeps groups of the same size in that order
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].Members > sizes[j].Members
+	})
+	if n < len(sizes) {
+		sizes = sizes[:n]
+	}
+	return sizes
+}
+
+// Returns how many messages the user hasn't seen in each of their groups, such as
+// "global (3), devs (1)", or an empty string if they've seen everything
+func (server *Server) unreadSummary(user string) string {
+	groupNames := server.userGroups(user)
+	unread := server.History.Unread(user, groupNames)
+	var counts []string
+	for _, groupName := range groupNames {
+		if count, ok := unread[groupName]; ok {
+			counts = append(counts, fmt.Sprintf("%s (%d)", groupName, count))
+		}
+	}
+	return strings.Join(counts, ", ")
+}
+
+// Returns a new unique ID to assign to a message
+func (server *Server) NextID() string {
+	return strconv.FormatUint(atomic.AddUint64(&server.lastID, 1), 10)
+}
+
+// Returns the 'join' messages that fill a client's cache with the groups the user is in and
+// their members, one per member of each group
+func (server *Server) cacheUpdates(user string) (cacheUpdates []*gochat.Msg) {
+	for _, groupName := range server.userGroups(user) {
+		if group, ok := server.Groups.Get(groupName); ok {
+			for _, groupMember := range group.Users.Array() {
+				cacheUpdates = append(cacheUpdates, &gochat.Msg{User: groupMember, To: groupName, Cmd: "join"})
+			}
+		}
+	}
+	return
+}
+
+// Welcomes the user to the group they were just added to. The other members are notified, and
+// the user is sent the group's members and pinned message so they can update their cache
+func (server *Server) joined(user, groupName string) (err error) {
+	server.History.MarkAllSeen(user, groupName)
+	server.Invites.Consume(user, groupName)
+	server.Hooks.userJoined(user, groupName)
+	// Notify all users in the group that this user joined
+	notice := &gochat.Msg{User: user, To: groupName, Cmd: "join"}
+	notice.Msg = fmt.Sprintf(server.Greetings.Joined, server.displayName(user))
+	if size, ok := server.Groups.Size(groupName); ok && server.ShowMemberCount {
+		notice.Msg = fmt.Sprintf(server.Greetings.JoinedCount, server.displayName(user), size, members(size))
+	}
+	errCh := make(chan error)
+	go server.SendGroupMsg(notice, errCh)
+	// Check for errors
+	for err := range errCh {
+		fmt.Println("Group message error:", err)
+	}
+	// Notify the user they joined
+	response := &gochat.Msg{User: user, To: groupName, Msg: fmt.Sprintf("You have joined the group %s.", groupName), Cmd: "join"}
+	err = server.SendMsg(response, user)
+	// Now send the user messages containing all groups currently in that group
+	// so they can update their local cache, unless it was deleted in the meantime
+	group, ok := server.Groups.Get(groupName)
+	if !ok {
+		return
+	}
+	for _, groupMember := range group.Users.Array() {
+		if groupMember != user {
+			cacheUpdate := &gochat.Msg{}
+			cacheUpdate.User = groupMember
+			cacheUpdate.To = groupName
+			cacheUpdate.Cmd = "join"
+			server.SendMsg(cacheUpdate, user)
+		}
+	}
+	// Along with the group's pinned message, if it has one
+	if group.Pinned != "" {
+		pinUpdate := &gochat.Msg{User: user, To: groupName, Msg: group.Pinned, Cmd: "pin"}
+		server.SendMsg(pinUpdate, user)
+	}
+	return
+}
+
+// Invites the target user (allowing a unique prefix of their name) to the group on behalf of
+// the user, and tells them how to accept. Returns the user invited
+func (server *Server) invite(user, groupName, name string) (target string, err error) {
+	if target, err = server.validateInviteTarget(groupName, name); err != nil {
+		return "", err
+	}
+	if ok := server.Invites.Add(target, groupName); !ok {
+		return "", errors.New(fmt.Sprintf("User %s has already been invited to the group %s.", target, groupName))
+	}
+	// Let the invited user know how to accept
+	inviteMsg := &gochat.Msg{User: user, To: groupName, Cmd: "invite"}
+	inviteMsg.Msg = fmt.Sprintf("%s %s invited you to join the group. Enter join %s to accept.", server.groupPrefix(groupName), server.displayName(user), groupName)
+	server.SendMsg(inviteMsg, target)
+	return target, nil
+}
+
+// Notifies the other members of the group the user was just removed from that they left
+func (server *Server) left(user, groupName string) {
+	server.Hooks.userLeft(user, groupName)
+	notice := &gochat.Msg{User: user, To: groupName, Cmd: "leave"}
+	notice.Msg = fmt.Sprintf(server.Greetings.Left, server.displayName(user))
+	errCh := make(chan error)
+	go server.SendGroupMsg(notice, errCh)
+	// Check for errors
+	for err := range errCh {
+		fmt.Println("Group message error:", err)
+	}
+}
+
+// Sends a group message from the user to everyone else in the group, recording it so members
+// can ack it. msg.Msg is normalized and has banned words masked first. Returns how many sends
+// failed, or an error if the group no longer exists
+// NOTE: The group will be in msg.To
+func (server *Server) postGroupMsg(msg *gochat.Msg) (failed int, err error) {
+	// The group may have been deleted since the message was validated
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Group %s doesn't exist.", msg.To))
+	}
+	// Clean up the message and mask any banned words before sending it on
+	msg.Msg = server.filterWords(server.normalize(msg.Msg))
+	server.Hooks.message(msg, msg.To)
+	// Record the message so we can track which members ack it
+	msg.ID = server.NextID()
+	var recipients []string
+	for _, groupMember := range group.Users.Array() {
+		if groupMember != msg.User {
+			recipients = append(recipients, groupMember)
+		}
+	}
+	server.History.Add(*msg, recipients)
+	// Send the message to all other users in the group
+	sent := *msg
+	sent.Msg = server.groupText(msg)
+	errCh := make(chan error)
+	go server.SendGroupMsg(&sent, errCh)
+	// Check for errors
+	for sendErr := range errCh {
+		fmt.Println("Group message error:", sendErr)
+		failed++
+	}
+	return
+}
+
+// Formats a group message as it's shown to the group's members, with its sender's name and role
+func (server *Server) groupText(msg *gochat.Msg) string {
+	// A group deleted in the meantime has no roles to show
+	tag := ""
+	if group, ok := server.Groups.Get(msg.To); ok {
+		tag = server.roleTag(group, msg.User)
+	}
+	return fmt.Sprintf("%s%s: %s", tag, server.displayName(msg.User), msg.Msg)
+}
+
+// Returns the tag shown before the user's name in the group's messages, "[owner] " or "[mod] ",
+// or an empty string for other members or if the Server doesn't show roles
+func (server *Server) roleTag(group gochat.Group, user string) string {
+	if !server.ShowRoles {
+		return ""
+	}
+	switch {
+	case group.Owner == user:
+		return "[owner] "
+	case group.Mods.Contains(user):
+		return "[mod] "
+	}
+	return ""
+}
+
+// Describes the report on a single line for admins
+func formatReport(report Report) string {
+	description := fmt.Sprintf("%s reported %s at %s: %s", report.Reporter, report.Target, report.Time.Format("2006-01-02 15:04:05"), report.Reason)
+	if len(report.Groups) > 0 {
+		description += fmt.Sprintf(" (in %s)", strings.Join(report.Groups, ", "))
+	}
+	return description
+}
+
+// Returns the most members the group may have, which is the stricter of its own limit and
+// MaxGroupSize, or 0 if it's unlimited
+func (server *Server) groupLimit(groupName string) int {
+	limit, _ := server.Groups.Limit(groupName)
+	if server.MaxGroupSize > 0 && (limit == 0 || server.MaxGroupSize < limit) {
+		return server.MaxGroupSize
+	}
+	return limit
+}
+
+// Returns if the group is frozen and the user isn't its owner, so they can't send messages to it
+func (server *Server) frozenFor(user, groupName string) bool {
+	frozen, _ := server.Groups.IsFrozen(groupName)
+	owner, _ := server.Groups.Owner(groupName)
+	return frozen && owner != user
+}
+
+// Returns how long the user must wait before using the command again, or 0 if they may use it
+// now, in which case the use is recorded if record is set. Only commands in cooldownCmds are
+// limited
+func (server *Server) cooldownRemaining(user, cmd string, record bool) (wait time.Duration) {
+	if server.Cooldown <= 0 || !cooldownCmds[cmd] {
+		return 0
+	}
+	key := cooldownKey{user, cmd}
+	now := time.Now()
+	server.cooldownLock.Lock()
+	if wait = server.lastUsed[key].Add(server.Cooldown).Sub(now); wait <= 0 {
+		if record {
+			server.lastUsed[key] = now
+		}
+		wait = 0
+	}
+	server.cooldownLock.Unlock()
+	return
+}
+
+// Returns the global group every user is in, creating it first if it doesn't exist
+func (server *Server) globalGroup() gochat.Group {
+	global, created := server.Groups.GetOrCreate("global", "")
+	if created {
+		fmt.Println("Created the global group.")
+	}
+	return global
+}
+
+// Returns the "[group]" prefix messages to the group are shown with. The global group is shown by
+// GlobalAlias if it's set, but is still routed as "global"
+func (server *Server) groupPrefix(group string) string {
+	if group == "global" && server.GlobalAlias != "" {
+		group = server.GlobalAlias
+	}
+	return fmt.Sprintf("[%s]", group)
+}
+
+// Returns the name the user is shown by in messages, which is their login name unless they've
+// set a display name
+func (server *Server) displayName(user string) string {
+	server.displayLock.RLock()
+	defer server.displayLock.RUnlock()
+	if name, ok := server.displayNames[user]; ok {
+		return name
+	}
+	return user
+}
+
+// Sets the name the user is shown by in messages. An empty name shows their login name.
+// Returns false without setting it if another user is already shown by the name
+func (server *Server) setDisplayName(user, name string) (ok bool) {
+	server.displayLock.Lock()
+	defer server.displayLock.Unlock()
+	if name == "" || name == user {
+		delete(server.displayNames, user)
+		return true
+	}
+	// Check again under the write lock, in case another user took it since it was validated
+	if server.displayNameTaken(user, name) {
+		return false
+	}
+	server.displayNames[user] = name
+	return true
+}
+
+// Returns if a user other than the given one is shown by the name, ignoring case. The display
+// lock must be held
+func (server *Server) displayNameTaken(user, name string) bool {
+	for other, display := range server.displayNames {
+		if other != user && strings.EqualFold(display, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the display name the user connected with, returning why they're shown by their login
+// name instead if they can't use it
+func (server *Server) connectDisplayName(user, name string) error {
+	if err := server.validateDisplayName(user, name); err != nil {
+		server.setDisplayName(user, "")
+		return err
+	}
+	if !server.setDisplayName(user, name) {
+		return errors.New(fmt.Sprintf("The name %s is already used by another user.", name))
+	}
+	return nil
+}
+
+// Tells the user why they couldn't use the display name they connected with, if they couldn't
+func (server *Server) displayNameRefused(user string, displayErr error) {
+	if displayErr == nil {
+		return
+	}
+	notice := &gochat.Msg{User: user, Msg: fmt.Sprintf("%s You're shown as %s instead.", displayErr, user)}
+	if err := server.SendMsg(notice, user); err != nil {
+		fmt.Println("Error sending display name notice:", err)
+	}
+}
+
+// Returns how long the user must wait before sending another message to the group under its
+// slow mode, or 0 if they may send it now, in which case the message is recorded. The owner and
+// moderators aren't limited
+func (server *Server) slowModeRemaining(user, groupName string) (wait time.Duration) {
+	group, ok := server.Groups.Get(groupName)
+	if !ok || group.SlowMode <= 0 || group.Owner == user || group.Mods.Contains(user) {
+		return 0
+	}
+	key := memberKey{user, groupName}
+	now := time.Now()
+	server.slowModeLock.Lock()
+	if wait = server.lastPosted[key].Add(group.SlowMode).Sub(now); wait <= 0 {
+		server.lastPosted[key] = now
+		wait = 0
+	}
+	server.slowModeLock.Unlock()
+	return
+}
+
+// Mutes the user in the group for the given duration, replacing any mute they already had
+func (server *Server) mute(user, group string, duration time.Duration) {
+	server.muteLock.Lock()
+	server.mutes[memberKey{user, group}] = time.Now().Add(duration)
+	server.muteLock.Unlock()
+}
+
+// Returns how long until the user is no longer muted in the group, or 0 if they aren't muted.
+// Expired mutes are removed
+func (server *Server) muteRemaining(user, group string) (wait time.Duration) {
+	key := memberKey{user, group}
+	server.muteLock.Lock()
+	if until, ok := server.mutes[key]; ok {
+		if wait = time.Until(until); wait <= 0 {
+			delete(server.mutes, key)
+			wait = 0
+		}
+	}
+	server.muteLock.Unlock()
+	return
+}
+
+// Resolves the target to one of the given users. If no user is named exactly the target, the
+// only user whose name starts with the target is used instead. If several users start with the
+// target they are returned as candidates, and if none do the target is returned unchanged
+func resolveUser(target string, users []string) (user string, candidates []string) {
+	if target == "" {
+		return target, nil
+	}
+	for _, user = range users {
+		if user == target {
+			return user, nil
+		}
+		if strings.HasPrefix(user, target) {
+			candidates = append(candidates, user)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return target, nil
+	case 1:
+		return candidates[0], nil
+	}
+	sort.Strings(candidates)
+	return "", candidates
+}
+
+// Returns the noun for the given number of group members
+func members(count int) string {
+	if count == 1 {
+		return "member"
+	}
+	return "members"
+}
+
+// Returns "message" or "messages" to follow the count
+func messages(count int) string {
+	if count == 1 {
+		return "message"
+	}
+	return "messages"
+}
+
+// Builds the message telling a user the name they gave matches several users
+func ambiguousUser(target string, candidates []string) string {
+	return fmt.Sprintf("User %s is ambiguous, did you mean: %s?", target, strings.Join(candidates, ", "))
+}
+
+// Builds the Addr a client can be reached at out of the host of its connection and the
+// port it reported it is listening on
+func listenAddr(conn net.Conn, port string) (addr gochat.Addr, err error) {
+	remote := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		// Not a host:port address (such as a net.Pipe), so the whole address is the host
+		host, err = remote, nil
+	}
+	if _, err = strconv.Atoi(port); err != nil {
+		return
+	}
+	return gochat.Addr{Address: host, Port: port}, nil
+}
+
+// Filters the groups down to those whose names match the glob pattern, as used by path.Match.
+// An empty pattern matches all groups. Returns an error if the pattern is malformed
+func matchGroups(infos []gochat.GroupInfo, pattern string) (matches []gochat.GroupInfo, err error) {
+	if pattern == "" {
+		return infos, nil
+	}
+	// Check the pattern up front so it's reported even if there are no groups to match
+	if _, err = path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if matched, _ := path.Match(pattern, info.Name); matched {
+			matches = append(matches, info)
+		}
+	}
+	return
+}
+
+// Describes the group for a listing, such as "devs (3 members, owned by ryan)"
+func describeGroup(info gochat.GroupInfo) string {
+	if info.Owner == "" {
+		return fmt.Sprintf("%s (%d %s)", info.Name, info.Members, members(info.Members))
+	}
+	return fmt.Sprintf("%s (%d %s, owned by %s)", info.Name, info.Members, members(info.Members), info.Owner)
+}
+
+// Wrapper to send a message to each device the user is connected from. Checks if the user has
+// an address, and only returns an error if the message couldn't be sent to any device. Devices
+// being skipped for being slow aren't sent to
+func (server *Server) SendMsg(msg *gochat.Msg, user string)  (err error) {
+	addrs := server.Addrs.All(user)
+	if len(addrs) == 0 {
+		return errors.New(fmt.Sprintf("Address for user %s not found.", user))
+	}
+	sent := false
+	skipped := 0
+	for _, addr := range addrs {
+		// Don't wait on a device that's been too slow to take its messages lately
+		if server.skipSlow(addr.String()) {
+			skipped++
+			continue
+		}
+		sendErr := server.Transport.Send(addr.String(), msg)
+		server.recordSend(user, addr, sendErr)
+		if sendErr != nil {
+			err = sendErr
+		} else {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	if skipped == len(addrs) {
+		return errSkipped
+	}
+	return
+}
+
+// Wrapper to send a message to all users of a group, including those on peer servers if it's a
+// group message
+func (server *Server) SendGroupMsg(msg *gochat.Msg, c chan error)  {
+	if msg.Cmd == "group" {
+		server.federate(msg, c)
+	}
+	server.sendGroupLocal(msg, c)
+}
+
+// Sends a message to all users of a group connected to this Server
+// NOTE: Each user is sent to in their own goroutine, so retrying one doesn't delay the others
+func (server *Server) sendGroupLocal(msg *gochat.Msg, c chan error)  {
+	if group, ok := server.Groups.Get(msg.To); ok {
+		var sends sync.WaitGroup
+		for _, user := range group.Users.Array() {
+			// Don't send the message to the user who wanted it sent, or chat to users who are
+			// away from the group
+			if user != msg.User && !(msg.Cmd == "group" && group.Away.Contains(user)) {
+				// Check if we have an address for the user
+				if server.Addrs.Online(user) {
+					//shallow copy
+					response := *msg
+					response.Msg = fmt.Sprintf("%s %s", server.groupPrefix(msg.To), msg.Msg)
+					// send the message
+					sends.Add(1)
+					go func(user string) {
+						defer sends.Done()
+						if err := server.sendWithRetry(&response, user); err != nil {
+							// send the error to the channel if we encounter one
+							c <- err
+						}
+					}(user)
+				} else {
+					// send the error to the channel if we encounter one
+					c <- errors.New(fmt.Sprintf("Could not find address for user %s.", user))
+					continue
+				}
+			}
+		}
+		// wait for every user to be sent to before closing the channel
+		sends.Wait()
+	} else {
+		// send the error to the channel if we encounter one
+		c <- errors.New(fmt.Sprintf("Group %s doesn't exist.", msg.To))
+	}
+	// close the channel so the HandleRequest goroutine can continue
+	close(c)
+}
+
+// Sends a message to a user, retrying up to SendRetries times with an exponential backoff
+// starting at RetryBackoff if it fails. Returns the error of the final attempt
+func (server *Server) sendWithRetry(msg *gochat.Msg, user string) (err error) {
+	backoff := server.RetryBackoff
+	attempt := 0
+	for {
+		err = server.SendMsg(msg, user)
+		// A message that's too large will never succeed, and one to a user being skipped for
+		// being slow won't be tried, so don't bother retrying them
+		if err == nil || err == gochat.ErrTooLarge || err == errSkipped || attempt >= server.SendRetries {
+			break
+		}
+		attempt++
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err != nil && attempt > 0 {
+		err = errors.New(fmt.Sprintf("Failed to send to %s after %d attempts: %s", user, attempt+1, err))
+	}
+	return
+}
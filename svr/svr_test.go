@@ -0,0 +1,696 @@
+package svr
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"github.com/zembrodt/gochat"
+)
+
+// A user of a test Server, with the messages the Server has sent them
+type testUser struct {
+	name string
+	token string
+	msgs chan *gochat.Msg
+}
+
+// Returns a Server that sends its messages over pipes from the returned PipeDialer
+func newTestServer() (*Server, *gochat.PipeDialer) {
+	dialer := gochat.NewPipeDialer()
+	server := NewServer("server", &gochat.TCPTransport{Dialer: dialer})
+	return server, dialer
+}
+
+// Listens for the messages the Server sends to the user's device on the given port. Requests
+// handled over a pipe come from the host "pipe", so that's where the Server sends them
+func listen(dialer *gochat.PipeDialer, name, port string) *testUser {
+	user := &testUser{name: name, msgs: make(chan *gochat.Msg, 100)}
+	dialer.Handle("pipe:" + port, func(conn net.Conn) {
+		defer conn.Close()
+		msg := &gochat.Msg{}
+		if err := msg.Retrieve(conn); err == nil {
+			user.msgs <- msg
+		}
+	})
+	return user
+}
+
+// Adds the user to the Server as if they had connected from the given port, without going
+// through 'init', so the tests can focus on other commands
+func addUser(server *Server, dialer *gochat.PipeDialer, name, port string) *testUser {
+	user := listen(dialer, name, port)
+	server.Addrs.Add(name, gochat.Addr{Address: "pipe", Port: port})
+	server.SeenUsers.Add(name)
+	server.globalGroup()
+	server.Groups.AddUser("global", name)
+	user.token = server.startSession(name)
+	return user
+}
+
+// Handles the request as if it was sent to the Server over a connection, returning once it's
+// been handled along with the reply sent back on the connection, if any
+func handle(server *Server, msg *gochat.Msg) *gochat.Msg {
+	conn, remote := net.Pipe()
+	replies := make(chan *gochat.Msg, 1)
+	go func() {
+		defer conn.Close()
+		if err := gob.NewEncoder(conn).Encode(msg); err != nil {
+			replies <- nil
+			return
+		}
+		reply := &gochat.Msg{}
+		if err := gob.NewDecoder(conn).Decode(reply); err != nil {
+			// The Server closed the connection without replying
+			reply = nil
+		}
+		replies <- reply
+	}()
+	server.HandleRequest(remote)
+	return <-replies
+}
+
+// Sends the request to the Server as the user, then waits for the Server to send them a message
+// with the given text
+func (user *testUser) request(t *testing.T, server *Server, msg *gochat.Msg, want string) *gochat.Msg {
+	t.Helper()
+	msg.User = user.name
+	handle(server, msg)
+	return user.expect(t, want)
+}
+
+// Waits for the Server to send the user a message with the given text, skipping any others,
+// such as notices about other users
+func (user *testUser) expect(t *testing.T, want string) *gochat.Msg {
+	t.Helper()
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-user.msgs:
+			if msg.Msg == want {
+				return msg
+			}
+			got = append(got, msg.Msg)
+		case <-timeout:
+			t.Fatalf("%s was never sent %q, only %q", user.name, want, got)
+		}
+	}
+}
+
+func TestPipeTransport(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+
+	handle(server, &gochat.Msg{User: "ryan", To: "mike", Msg: "hi", Cmd: "dm"})
+	if received := mike.expect(t, "ryan whispers hi"); received.ID == "" {
+		t.Error("mike was sent the direct message without an ID")
+	}
+	ryan.request(t, server, &gochat.Msg{To: "tony", Msg: "hi", Cmd: "dm"}, "User tony isn't online.")
+}
+
+func TestRename(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "You created the group team!")
+	ryan.request(t, server, &gochat.Msg{To: "band", Cmd: "create"}, "You created the group band!")
+	mike.request(t, server, &gochat.Msg{To: "team", Cmd: "join"}, "You have joined the group team.")
+
+	tests := []struct {
+		user *testUser
+		group, name string
+		want string
+	}{
+		{mike, "team", "crew", "You don't have permission to rename the group team!"},
+		{ryan, "gang", "crew", "Group gang doesn't exist!"},
+		{ryan, "team", "", "Please enter a new name for the group."},
+		{ryan, "team", "band", "Group band already exists!"},
+		{ryan, "global", "lobby", "The group global can't be renamed!"},
+	}
+	for _, test := range tests {
+		test.user.request(t, server, &gochat.Msg{To: test.group, Msg: test.name, Cmd: "rename"}, test.want)
+	}
+
+	// Every member is sent the rename so they can update their cache
+	handle(server, &gochat.Msg{User: "ryan", To: "team", Msg: "crew", Cmd: "rename"})
+	ryan.expect(t, "crew")
+	mike.expect(t, "crew")
+	if _, ok := server.Groups.Get("team"); ok {
+		t.Error("Group team still exists after it was renamed")
+	}
+	if contains, ok := server.Groups.ContainsUser("crew", "mike"); !ok || !contains {
+		t.Errorf("Group crew exists: %v, has mike: %v, want both after the rename", ok, contains)
+	}
+	if owner, _ := server.Groups.Owner("crew"); owner != "ryan" {
+		t.Errorf("Group crew is owned by %q after the rename, want ryan", owner)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	addUser(server, dialer, "tony", "3")
+
+	handle(server, &gochat.Msg{User: "ryan", To: "mike", Msg: "hi", Cmd: "dm"})
+	id := mike.expect(t, "ryan whispers hi").ID
+	// Receipts from anyone but the recipient, for messages that weren't sent, or to anyone but
+	// the sender aren't relayed, and don't stop the recipient's own receipt from being relayed
+	handle(server, &gochat.Msg{User: "tony", To: "ryan", ID: id, Cmd: "read"})
+	handle(server, &gochat.Msg{User: "mike", To: "ryan", ID: "999", Cmd: "read"})
+	handle(server, &gochat.Msg{User: "mike", To: "tony", ID: id, Cmd: "read"})
+	handle(server, &gochat.Msg{User: "mike", To: "ryan", ID: id, Cmd: "read"})
+	// Only one receipt is relayed for each message
+	handle(server, &gochat.Msg{User: "ryan", To: "mike", Msg: "again", Cmd: "dm"})
+	again := mike.expect(t, "ryan whispers again").ID
+	handle(server, &gochat.Msg{User: "mike", To: "ryan", ID: again, Cmd: "read"})
+	handle(server, &gochat.Msg{User: "mike", To: "ryan", ID: again, Cmd: "read"})
+
+	var receipts []string
+	timeout := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case msg := <-ryan.msgs:
+			if msg.Cmd == "read" {
+				receipts = append(receipts, fmt.Sprintf("%s read %s", msg.User, msg.ID))
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	want := []string{fmt.Sprintf("mike read %s", id), fmt.Sprintf("mike read %s", again)}
+	sort.Strings(receipts)
+	sort.Strings(want)
+	if !reflect.DeepEqual(receipts, want) {
+		t.Errorf("ryan was sent the receipts %q, want %q", receipts, want)
+	}
+}
+
+func TestGroupDelivery(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "You created the group team!")
+	mike.request(t, server, &gochat.Msg{To: "team", Cmd: "join"}, "You have joined the group team.")
+
+	sent := ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "group", Msg: "hello"}, "[team] ryan: hello")
+	received := mike.expect(t, "[team] ryan: hello")
+	if received.ID == "" || received.ID != sent.ID {
+		t.Fatalf("mike was sent message ID %q, ryan was told %q", received.ID, sent.ID)
+	}
+	ryan.request(t, server, &gochat.Msg{To: sent.ID, Cmd: "delivery"}, fmt.Sprintf("Message %s hasn't reached 1 member yet.", sent.ID))
+	handle(server, &gochat.Msg{User: "mike", ID: sent.ID, Cmd: "ack"})
+	ryan.request(t, server, &gochat.Msg{To: sent.ID, Cmd: "delivery"}, fmt.Sprintf("Message %s has reached every member.", sent.ID))
+	ryan.request(t, server, &gochat.Msg{To: "999", Cmd: "delivery"}, "Message 999 isn't in the history.")
+	ryan.request(t, server, &gochat.Msg{Cmd: "delivery"}, "Please enter the ID of the message to check.")
+
+	// A message posted to a group that's gone is refused rather than sent to no one
+	server.Groups.Delete("team")
+	if _, err := server.postGroupMsg(&gochat.Msg{User: "ryan", To: "team", Msg: "anyone?"}); err == nil {
+		t.Error("postGroupMsg to a deleted group didn't return an error")
+	}
+	if text := server.groupText(&gochat.Msg{User: "ryan", To: "team", Msg: "hi"}); text != "ryan: hi" {
+		t.Errorf("groupText for a deleted group is %q, want %q", text, "ryan: hi")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	server, dialer := newTestServer()
+	server.Cooldown = time.Hour
+	ryan := addUser(server, dialer, "ryan", "1")
+	addUser(server, dialer, "mike", "2")
+
+	tests := []struct {
+		cmd, args string
+		want string
+	}{
+		{"create", "team", "create team would succeed."},
+		{"create", "", "create would fail: Please enter a name for the group."},
+		{"join", "band", "join band would fail: Group band doesn't exist."},
+		{"dm", "mike hi", "dm mike hi would succeed."},
+		{"rename", "global lobby", "rename global lobby would fail: The group global can't be renamed!"},
+		{"help", "", "help would succeed."},
+	}
+	for _, test := range tests {
+		ryan.request(t, server, &gochat.Msg{To: test.cmd, Msg: test.args, Cmd: "validate"}, test.want)
+	}
+	// Checking a command neither runs it nor counts towards its cooldown
+	if _, ok := server.Groups.Get("team"); ok {
+		t.Error("Validating create made the group")
+	}
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "You created the group team!")
+	ryan.request(t, server, &gochat.Msg{To: "create", Msg: "band", Cmd: "validate"}, "create band would fail: Please wait 3600 seconds before using create again.")
+	ryan.request(t, server, &gochat.Msg{To: "band", Cmd: "create"}, "Please wait 3600 seconds before using create again.")
+}
+
+func TestDisconnectManyGroups(t *testing.T) {
+	server, dialer := newTestServer()
+	addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	for i := 0; i < 50; i++ {
+		group := fmt.Sprintf("group%d", i)
+		server.Groups.Create(group, "mike")
+		server.Groups.AddUser(group, "mike")
+		server.Groups.AddUser(group, "ryan")
+	}
+	handle(server, &gochat.Msg{User: "ryan", Msg: "1", Cmd: "disconnect"})
+	if server.Addrs.Online("ryan") {
+		t.Error("ryan is still online after disconnecting")
+	}
+	if groups := server.Groups.UserGroups("ryan"); len(groups) != 0 {
+		t.Errorf("ryan is still in %v after disconnecting", groups)
+	}
+	if groups := server.Groups.UserGroups("mike"); len(groups) != 51 {
+		t.Errorf("mike is in %d groups after ryan disconnected, want 51", len(groups))
+	}
+	// Every notice is sent before the disconnect returns
+	for i := 0; i < 51; i++ {
+		select {
+		case <-mike.msgs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("mike was only sent %d of 51 notices that ryan left", i)
+		}
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	server, dialer := newTestServer()
+	server.HandleBot("roll", RollBot)
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+
+	tests := []struct {
+		user *testUser
+		name string
+		want string
+	}{
+		{mike, "", "Please enter a display name."},
+		{mike, "Ryan", "The name Ryan is already used by another user."},
+		{mike, "[owner] mike", "Display names can't contain [ or ], which roles and groups are shown in."},
+				{mike, "bot", "The name bot is already used by another user."},
+		{mike, "Mikey", "You will now be shown as Mikey."},
+		{ryan, "mikey", "The name mikey is already used by another user."},
+		{mike, "mike", "You will now be shown as mike."},
+		{ryan, "Mikey", "You will now be shown as Mikey."},
+	}
+	for _, test := range tests {
+		test.user.request(t, server, &gochat.Msg{To: test.name, Cmd: "display"}, test.want)
+	}
+	ryan.request(t, server, &gochat.Msg{To: "global", Cmd: "group", Msg: "hi"}, "[global] Mikey: hi")
+}
+
+func TestDisabled(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+
+	server.Disabled.AddAll([]string{"dm", "init", "disconnect"})
+	ryan.request(t, server, &gochat.Msg{To: "mike", Msg: "hi", Cmd: "dm"}, "The command dm is disabled on this server.")
+	ryan.request(t, server, &gochat.Msg{To: "dm", Msg: "mike hi", Cmd: "validate"}, "dm mike hi would fail: The command dm is disabled on this server.")
+	// Other commands still work
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "You created the group team!")
+	// Commands needed to connect and disconnect can't be disabled
+	listen(dialer, "tony", "3")
+	if reply := handle(server, &gochat.Msg{User: "tony", Msg: "3", Cmd: "init"}); reply == nil || reply.Cmd != "init" {
+		t.Errorf("init replied %+v while disabled, want it to still work", reply)
+	}
+	handle(server, &gochat.Msg{User: "tony", Msg: "3", Cmd: "disconnect"})
+	if server.Addrs.Online("tony") {
+		t.Error("tony is still online after disconnecting while it's disabled")
+	}
+
+	// Turning the command back on lets it be used again
+	server.Disabled.Remove("dm")
+	handle(server, &gochat.Msg{User: "ryan", To: "mike", Msg: "hi", Cmd: "dm"})
+	mike.expect(t, "ryan whispers hi")
+}
+
+func TestDelete(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	ryan.request(t, server, &gochat.Msg{To: "crew", Cmd: "create"}, "You created the group crew!")
+	mike.request(t, server, &gochat.Msg{To: "crew", Cmd: "join"}, "You have joined the group crew.")
+
+	mike.request(t, server, &gochat.Msg{To: "crew", Cmd: "delete"}, "You don't have permission to delete the group crew!")
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "delete"}, "Group team doesn't exist!")
+	ryan.request(t, server, &gochat.Msg{To: "global", Cmd: "delete"}, "The group global can't be deleted!")
+	ryan.request(t, server, &gochat.Msg{To: "crew", Cmd: "delete"}, "You deleted the group crew!")
+	mike.expect(t, "[crew] has been deleted.")
+	if groups := server.Groups.UserGroups("mike"); len(groups) != 1 {
+		t.Errorf("mike is still in %v after crew was deleted", groups)
+	}
+}
+
+func TestGlobalRecreated(t *testing.T) {
+	server, dialer := newTestServer()
+	listen(dialer, "ryan", "1")
+	server.Groups.Delete("global")
+	if reply := handle(server, &gochat.Msg{User: "ryan", Msg: "1", Cmd: "init"}); reply == nil || reply.Cmd != "init" {
+		t.Fatalf("init replied %+v without a global group", reply)
+	}
+	if contains, ok := server.Groups.ContainsUser("global", "ryan"); !ok || !contains {
+		t.Errorf("global wasn't recreated with ryan in it, it exists: %v, has ryan: %v", ok, contains)
+	}
+	// It's recreated again for a user reconnecting
+	token := server.sessions["ryan"].token
+	server.Groups.Delete("global")
+	listen(dialer, "ryan", "2")
+	handle(server, &gochat.Msg{User: "ryan", Msg: "2", Cmd: "init", Token: token})
+	if contains, ok := server.Groups.ContainsUser("global", "ryan"); !ok || !contains {
+		t.Errorf("global wasn't recreated on reconnect, it exists: %v, has ryan: %v", ok, contains)
+	}
+}
+
+func TestInitDevices(t *testing.T) {
+	server, dialer := newTestServer()
+	server.HandleBot("roll", RollBot)
+	listen(dialer, "ryan", "1")
+	listen(dialer, "ryan", "2")
+
+	reply := handle(server, &gochat.Msg{User: "ryan", Msg: "1", Cmd: "init"})
+	if reply == nil || reply.Cmd != "init" || reply.Msg != "1" || reply.Token == "" {
+		t.Fatalf("init replied %+v, want the port and a token", reply)
+	}
+	token := reply.Token
+
+	tests := []struct {
+		name string
+		msg *gochat.Msg
+		cmd string
+		devices int
+	}{
+		{"taken name", &gochat.Msg{User: "ryan", Msg: "2", Cmd: "init"}, "alreadyExists", 1},
+		{"wrong token", &gochat.Msg{User: "ryan", Msg: "2", Cmd: "init", Token: "guess"}, "alreadyExists", 1},
+		{"bad port", &gochat.Msg{User: "mike", Msg: "port", Cmd: "init"}, "invalidPort", 1},
+		{"bot name", &gochat.Msg{User: defaultBotName, Msg: "3", Cmd: "init"}, "alreadyExists", 1},
+		{"second device", &gochat.Msg{User: "ryan", Msg: "2", Cmd: "init", Token: token}, "init", 2},
+	}
+	for _, test := range tests {
+		if reply := handle(server, test.msg); reply == nil || reply.Cmd != test.cmd {
+			t.Errorf("%s: init replied %+v, want %s", test.name, reply, test.cmd)
+		}
+		if devices := len(server.Addrs.All("ryan")); devices != test.devices {
+			t.Errorf("%s: ryan has %d devices, want %d", test.name, devices, test.devices)
+		}
+	}
+
+	// Disconnecting one device, or one they don't have, leaves them online
+	for _, port := range []string{"9", "1"} {
+		handle(server, &gochat.Msg{User: "ryan", Msg: port, Cmd: "disconnect"})
+		if contains, _ := server.Groups.ContainsUser("global", "ryan"); !server.Addrs.Online("ryan") || !contains {
+			t.Errorf("ryan went offline after disconnecting port %s with another device connected", port)
+		}
+	}
+	handle(server, &gochat.Msg{User: "ryan", Msg: "2", Cmd: "disconnect"})
+	if server.Addrs.Online("ryan") {
+		t.Error("ryan is still online after disconnecting their last device")
+	}
+	if server.renewSession("ryan", token) {
+		t.Error("ryan's session is still valid after they went offline")
+	}
+
+	// A disconnect without a port ends all of the user's sessions
+	reply = handle(server, &gochat.Msg{User: "ryan", Msg: "1", Cmd: "init"})
+	handle(server, &gochat.Msg{User: "ryan", Msg: "2", Cmd: "init", Token: reply.Token})
+	handle(server, &gochat.Msg{User: "ryan", Cmd: "disconnect"})
+	if contains, _ := server.Groups.ContainsUser("global", "ryan"); server.Addrs.Online("ryan") || contains {
+		t.Error("ryan is still online after disconnecting without a port")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "You created the group team!")
+
+	tests := []struct {
+		group string
+		want string
+	}{
+		{"band", "Group band doesn't exist."},
+		{"team", "You have joined the group team."},
+		{"team", "You're already in the group team."},
+	}
+	for _, test := range tests {
+		mike.request(t, server, &gochat.Msg{To: test.group, Cmd: "join"}, test.want)
+	}
+	// The group is told when mike joins
+	ryan.expect(t, "[team] mike has joined the group.")
+	if contains, _ := server.Groups.ContainsUser("team", "mike"); !contains {
+		t.Error("mike isn't in the group team after joining it")
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	tests := []struct {
+		normalization Normalization
+		text, want string
+	}{
+		{NormalizeNone, " a\tb \r\n", " a\tb \r\n"},
+		{NormalizeTrailing, " a\tb \r\n", " a\tb"},
+		{NormalizeTrailing, "a\nb", "a\nb"},
+		{NormalizeFull, " a\tb \r\n", `a\tb`},
+		{NormalizeFull, "a\r\nb", `a\r\nb`},
+		{NormalizeFull, "a\x07b", `a\x07b`},
+	}
+	for _, test := range tests {
+		server := NewServer("server", nil)
+		server.Normalization = test.normalization
+		if got := server.normalize(test.text); got != test.want {
+			t.Errorf("normalize(%q) with %d = %q, want %q", test.text, test.normalization, got, test.want)
+		}
+	}
+}
+
+func TestNormalizedGroupMessage(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "You created the group team!")
+	mike.request(t, server, &gochat.Msg{To: "team", Cmd: "join"}, "You have joined the group team.")
+
+	// Trailing whitespace is trimmed by default before the message is sent to the group
+	handle(server, &gochat.Msg{User: "ryan", To: "team", Cmd: "group", Msg: "hello \t\r\n"})
+	mike.expect(t, "[team] ryan: hello")
+	server.Normalization = NormalizeFull
+	handle(server, &gochat.Msg{User: "ryan", To: "team", Cmd: "group", Msg: "a\x1bb"})
+	mike.expect(t, `[team] ryan: a\x1bb`)
+}
+
+func TestSignatures(t *testing.T) {
+	server, dialer := newTestServer()
+	server.RequireSignatures = true
+	ryan := addUser(server, dialer, "ryan", "1")
+	addUser(server, dialer, "mike", "2")
+	posted := func() int {
+		count, _ := server.History.CountSince("global", time.Time{})
+		return count
+	}
+	post := func(text string) *gochat.Msg {
+		return &gochat.Msg{User: "ryan", To: "global", Cmd: "group", Msg: text}
+	}
+
+	signed := post("signed")
+	signed.Sign([]byte(ryan.token))
+	handle(server, signed)
+	if posted() != 1 {
+		t.Fatalf("A signed message wasn't posted")
+	}
+
+	tampered := post("signed")
+	tampered.Sign([]byte(ryan.token))
+	tampered.Msg = "changed"
+	wrongUser := post("forged")
+	wrongUser.User = "mike"
+	wrongUser.Sign([]byte(ryan.token))
+	tests := []struct {
+		name string
+		msg *gochat.Msg
+	}{
+		{"replayed", signed},
+		{"unsigned", post("unsigned")},
+		{"tampered", tampered},
+		{"signed by another user", wrongUser},
+	}
+	for _, test := range tests {
+		handle(server, test.msg)
+		if count := posted(); count != 1 {
+			t.Errorf("%s message was posted, global has %d messages", test.name, count)
+		}
+	}
+
+	// A message signed too long ago is rejected even if the signature is valid
+	server.SignatureMaxAge = time.Millisecond
+	old := post("old")
+	old.Sign([]byte(ryan.token))
+	time.Sleep(10 * time.Millisecond)
+	if server.fresh(old) {
+		t.Error("A message signed longer ago than SignatureMaxAge is fresh")
+	}
+	server.SignatureMaxAge = time.Minute
+	again := post("again")
+	again.Sign([]byte(ryan.token))
+	if !server.fresh(again) || server.fresh(again) {
+		t.Error("fresh didn't accept a new message once and reject it after")
+	}
+}
+
+func TestReceivedLogRedacted(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	handle(server, &gochat.Msg{User: "ryan", To: "global", Cmd: "group", Msg: "hi", Token: ryan.token, Payload: []byte("secret payload")})
+	os.Stdout = stdout
+	writer.Close()
+	logged, _ := ioutil.ReadAll(reader)
+	if !strings.Contains(string(logged), "Received : ") {
+		t.Fatalf("The message wasn't logged, stdout was %q", logged)
+	}
+	if strings.Contains(string(logged), ryan.token) || strings.Contains(string(logged), "secret payload") ||
+		strings.Contains(string(logged), fmt.Sprint([]byte("secret payload"))) {
+		t.Errorf("The log includes the token or payload: %q", logged)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	server, dialer := newTestServer()
+	server.MaxGroupsPerUser = 2
+	ryan := addUser(server, dialer, "ryan", "1")
+
+	tests := []struct {
+		group string
+		want string
+	}{
+		{"", "Please enter a name for the group."},
+		{"team", "You created the group team!"},
+		{"team", "Group team already exists!"},
+		{"crew", "You created the group crew!"},
+		{"band", "You can't create more groups, you already own 2 of the 2 allowed."},
+	}
+	for _, test := range tests {
+		ryan.request(t, server, &gochat.Msg{To: test.group, Cmd: "create"}, test.want)
+	}
+	if owned := server.Groups.OwnedCount("ryan"); owned != 2 {
+		t.Errorf("ryan owns %d groups, want 2", owned)
+	}
+	if contains, _ := server.Groups.ContainsUser("team", "ryan"); !contains {
+		t.Error("ryan isn't in the group they created")
+	}
+}
+
+func TestClear(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "You created the group team!")
+	mike.request(t, server, &gochat.Msg{To: "team", Cmd: "join"}, "You have joined the group team.")
+	for i := 0; i < 2; i++ {
+		ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "group", Msg: "hi"}, "[team] ryan: hi")
+	}
+	ryan.request(t, server, &gochat.Msg{To: "global", Cmd: "group", Msg: "hi"}, "[global] ryan: hi")
+
+	// Only the owner can clear the history, and it leaves other groups' alone
+	mike.request(t, server, &gochat.Msg{To: "team", Cmd: "clear"}, "You don't have permission to clear group team!")
+	if count, _ := server.History.CountSince("team", time.Time{}); count != 2 {
+		t.Errorf("team has %d messages after mike tried to clear it, want 2", count)
+	}
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "clear"}, "[team] You cleared 2 messages from the group's history.")
+	mike.expect(t, "[team] The group's history was cleared by its owner.")
+	if count, _ := server.History.CountSince("team", time.Time{}); count != 0 {
+		t.Errorf("team has %d messages after it was cleared, want 0", count)
+	}
+	if count, _ := server.History.CountSince("global", time.Time{}); count != 1 {
+		t.Errorf("global has %d messages after team was cleared, want 1", count)
+	}
+}
+
+func TestGlobalAlias(t *testing.T) {
+	server, dialer := newTestServer()
+	server.GlobalAlias = "lobby"
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+
+	// The alias is only shown, messages are still routed to global
+	ryan.request(t, server, &gochat.Msg{To: "global", Cmd: "group", Msg: "hi"}, "[lobby] ryan: hi")
+	if received := mike.expect(t, "[lobby] ryan: hi"); received.To != "global" {
+		t.Errorf("mike was sent the message to %s, want global", received.To)
+	}
+	if prefix := server.groupPrefix("team"); prefix != "[team]" {
+		t.Errorf("Other groups are shown as %s, want [team]", prefix)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	server, dialer := newTestServer()
+	server.HandleBot("roll", func(msg gochat.Msg, args string) string { return "4" })
+	ryan := addUser(server, dialer, "ryan", "1")
+	addUser(server, dialer, "mike", "2")
+	published := server.Subscribe()
+	defer server.Unsubscribe(published)
+	server.Disabled.Add("create")
+
+	// Disabled commands, and ones that fail validation, aren't published
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "The command create is disabled on this server.")
+	ryan.request(t, server, &gochat.Msg{To: "band", Cmd: "join"}, "Group band doesn't exist.")
+	handle(server, &gochat.Msg{User: "ryan", To: "global", Cmd: "group", Msg: "roll", Token: ryan.token})
+
+	want := []struct {
+		user, msg string
+	}{
+		{"ryan", "roll"},
+		{defaultBotName, "4"},
+	}
+	for _, w := range want {
+		select {
+		case msg := <-published:
+			if msg.User != w.user || msg.Msg != w.msg || msg.Token != "" {
+				t.Errorf("Published %+v, want %s's message %q without a token", msg, w.user, w.msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s's message %q was never published", w.user, w.msg)
+		}
+	}
+	select {
+	case msg := <-published:
+		t.Errorf("Published unexpected message %+v", msg)
+	default:
+	}
+}
+
+func TestActivity(t *testing.T) {
+	server, dialer := newTestServer()
+	ryan := addUser(server, dialer, "ryan", "1")
+	mike := addUser(server, dialer, "mike", "2")
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "create"}, "You created the group team!")
+	activity := func(count int) string {
+		text := "[team] Activity:"
+		for _, window := range activityWindows {
+			text += fmt.Sprintf("\n * %d %s in the last %s", count, messages(count), window.Name)
+		}
+		return text
+	}
+	ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "activity"}, activity(0))
+	mike.request(t, server, &gochat.Msg{To: "team", Cmd: "join"}, "You have joined the group team.")
+	for i := 0; i < 2; i++ {
+		ryan.request(t, server, &gochat.Msg{To: "team", Cmd: "group", Msg: "hi"}, "[team] ryan: hi")
+	}
+	// Messages to other groups aren't counted
+	ryan.request(t, server, &gochat.Msg{To: "global", Cmd: "group", Msg: "hi"}, "[global] ryan: hi")
+	mike.request(t, server, &gochat.Msg{To: "team", Cmd: "activity"}, activity(2))
+	mike.request(t, server, &gochat.Msg{To: "band", Cmd: "activity"}, "Group band doesn't exist.")
+}
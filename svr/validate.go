@@ -0,0 +1,561 @@
+package svr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/zembrodt/gochat"
+)
+
+// Checks whether the user's command would succeed, without changing any state on the Server.
+// Returns an error explaining why the command would fail, which is the message HandleRequest
+// sends back to the user when it fails. Commands that can't fail always pass
+func (server *Server) Validate(msg *gochat.Msg) (err error) {
+	if err = server.checkAllowed(msg, false); err != nil {
+		return
+	}
+	switch msg.Cmd {
+	case "join":
+		err = server.validateJoin(msg)
+	case "dm", "key":
+		_, err = server.validateDM(msg)
+	case "group":
+		err = server.validateGroup(msg)
+	case "reply":
+		_, err = server.validateReply(msg)
+	case "delivery":
+		err = server.validateDelivery(msg)
+	case "leave":
+		err = server.validateLeave(msg)
+	case "move":
+		err = server.validateMove(msg)
+	case "create":
+		err = server.validateCreate(msg)
+	case "delete":
+		err = server.validateDelete(msg)
+	case "rename":
+		err = server.validateRename(msg)
+	case "list":
+		_, err = matchGroups(nil, msg.To)
+	case "mod":
+		err = server.validateMod(msg)
+	case "topgroups":
+		_, err = server.validateTopGroups(msg)
+	case "recent":
+		_, err = server.validateRecent(msg)
+	case "report":
+		_, err = server.validateReport(msg)
+	case "reports", "allusers":
+		err = server.validateAdmin(msg)
+	case "usergroups", "addr":
+		err = server.validateAdmin(msg)
+	case "slowmode":
+		_, err = server.validateSlowMode(msg)
+	case "limit":
+		_, err = server.validateLimit(msg)
+	case "tempmute":
+		_, _, err = server.validateTempMute(msg)
+	case "freeze", "unfreeze", "clear":
+		err = server.validateOwner(msg)
+	case "afk", "back":
+		err = server.validateAway(msg)
+	case "pin", "unpin":
+		err = server.validatePin(msg)
+	case "pinned", "diff":
+		err = server.validateGroup(msg)
+	case "invite":
+		_, err = server.validateInvite(msg)
+	case "promote":
+		_, err = server.validatePromote(msg)
+	case "display":
+		err = server.validateDisplay(msg)
+	case "friend", "unfriend":
+		_, err = server.validateFriend(msg)
+	case "kick":
+		_, err = server.validateKick(msg)
+	}
+	return
+}
+
+// Checks a display name was given in msg.To that the user may be shown by
+func (server *Server) validateDisplay(msg *gochat.Msg) error {
+	if msg.To == "" {
+		return errors.New("Please enter a display name.")
+	}
+	return server.validateDisplayName(msg.User, msg.To)
+}
+
+// Checks the user may be shown by the name, so no one can pass themselves off as someone else.
+// The name can't contain the brackets roles and groups are shown in, such as [owner], or be
+// another user's login or display name, or the bot's, ignoring case. An empty name or the
+// user's own login name is always allowed
+func (server *Server) validateDisplayName(user, name string) error {
+	if name == "" || name == user {
+		return nil
+	}
+	if strings.ContainsAny(name, "[]") {
+		return errors.New("Display names can't contain [ or ], which roles and groups are shown in.")
+	}
+	isOther := func(other string) bool {
+		return other != user && strings.EqualFold(other, name)
+	}
+	_, isUser := server.SeenUsers.Find(isOther)
+	server.displayLock.RLock()
+	isDisplayed := server.displayNameTaken(user, name)
+	server.displayLock.RUnlock()
+	if isUser || isDisplayed || server.isBot(name) {
+		return errors.New(fmt.Sprintf("The name %s is already used by another user.", name))
+	}
+	return nil
+}
+
+// Checks the Server lets the user use the command right now: it isn't Disabled, and the user
+// isn't waiting out its Cooldown. HandleRequest sets record so the use counts towards the
+// Cooldown, while Validate leaves it unset so checking doesn't
+func (server *Server) checkAllowed(msg *gochat.Msg, record bool) error {
+	if server.Disabled.Contains(msg.Cmd) && !requiredCmds[msg.Cmd] {
+		return errors.New(fmt.Sprintf("The command %s is disabled on this server.", msg.Cmd))
+	}
+	if wait := server.cooldownRemaining(msg.User, msg.Cmd, record); wait > 0 {
+		return errors.New(fmt.Sprintf("Please wait %d seconds before using %s again.", int(math.Ceil(wait.Seconds())), msg.Cmd))
+	}
+	return nil
+}
+
+// Checks the group exists and the user isn't already in it
+func (server *Server) validateJoin(msg *gochat.Msg) error {
+	contains, ok := server.Groups.ContainsUser(msg.To, msg.User)
+	if !ok {
+		return errors.New(fmt.Sprintf("Group %s doesn't exist.", msg.To))
+	}
+	if contains {
+		return errors.New(fmt.Sprintf("You're already in the group %s.", msg.To))
+	}
+	if limit := server.groupLimit(msg.To); limit > 0 {
+		if size, _ := server.Groups.Size(msg.To); size >= limit {
+			return errors.New(fmt.Sprintf("Group %s is full, it has %d of %d members.", msg.To, size, limit))
+		}
+	}
+	return nil
+}
+
+// Checks the target of a direct message is online, allowing a unique prefix of their name.
+// Returns the user the message is for
+func (server *Server) validateDM(msg *gochat.Msg) (to string, err error) {
+	to, candidates := resolveUser(msg.To, server.Addrs.Users())
+	if len(candidates) > 1 {
+		return "", errors.New(ambiguousUser(msg.To, candidates))
+	}
+	if !server.Addrs.Online(to) {
+		return "", errors.New(fmt.Sprintf("User %s isn't online.", msg.To))
+	}
+	return to, nil
+}
+
+// Returned when a user tries to use a group they aren't in, or that doesn't exist
+type MembershipError struct {
+	User, Group string
+	Exists bool // whether the group exists
+}
+
+func (err *MembershipError) Error() string {
+	if !err.Exists {
+		return fmt.Sprintf("Group %s doesn't exist.", err.Group)
+	}
+	return fmt.Sprintf("You aren't in the group %s.", err.Group)
+}
+
+// Checks the group exists and the user is in it, returning a *MembershipError if not. Every
+// command that needs the user to have joined the group first checks it here, so they're all
+// turned away the same way
+func (server *Server) requireMember(user, groupName string) error {
+	contains, ok := server.Groups.ContainsUser(groupName, user)
+	if !ok || !contains {
+		return &MembershipError{User: user, Group: groupName, Exists: ok}
+	}
+	return nil
+}
+
+// Checks the group message with the ID in msg.To is in the History, and the user is in the group
+// it was sent to
+func (server *Server) validateDelivery(msg *gochat.Msg) error {
+	if msg.To == "" {
+		return errors.New("Please enter the ID of the message to check.")
+	}
+	sent, ok := server.History.Get(msg.To)
+	if !ok {
+		return errors.New(fmt.Sprintf("Message %s isn't in the history.", msg.To))
+	}
+	return server.requireMember(msg.User, sent.To)
+}
+
+// Checks the group exists and the user is in it
+func (server *Server) validateGroup(msg *gochat.Msg) error {
+	return server.requireMember(msg.User, msg.To)
+}
+
+// Checks the message being replied to (given by msg.To) is in the History, and the user is in
+// the group it was sent to. Returns the group
+func (server *Server) validateReply(msg *gochat.Msg) (group string, err error) {
+	if msg.To == "" {
+		return "", errors.New("Please enter the ID of the message to reply to.")
+	}
+	parent, ok := server.History.Get(msg.To)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Message %s isn't in the history.", msg.To))
+	}
+	if err = server.requireMember(msg.User, parent.To); err != nil {
+		return "", err
+	}
+	return parent.To, nil
+}
+
+// Checks the group exists and the user is in it
+func (server *Server) validateLeave(msg *gochat.Msg) error {
+	return server.requireMember(msg.User, msg.To)
+}
+
+// Checks the user is in the group they're moving from and can join the group they're moving
+// to (given by msg.Msg)
+func (server *Server) validateMove(msg *gochat.Msg) error {
+	if msg.Msg == "" {
+		return errors.New("Please enter the group to move to.")
+	}
+	if err := server.validateLeave(msg); err != nil {
+		return err
+	}
+	return server.validateJoin(&gochat.Msg{User: msg.User, To: msg.Msg})
+}
+
+// Checks a group name was given, the group doesn't exist yet, and the user doesn't already own
+// as many groups as MaxGroupsPerUser allows
+func (server *Server) validateCreate(msg *gochat.Msg) error {
+	if msg.To == "" {
+		return errors.New("Please enter a name for the group.")
+	}
+	if _, ok := server.Groups.Get(msg.To); ok {
+		return errors.New(fmt.Sprintf("Group %s already exists!", msg.To))
+	}
+	if owned := server.Groups.OwnedCount(msg.User); server.MaxGroupsPerUser > 0 && owned >= server.MaxGroupsPerUser {
+		return errors.New(fmt.Sprintf("You can't create more groups, you already own %d of the %d allowed.", owned, server.MaxGroupsPerUser))
+	}
+	return nil
+}
+
+// Checks the group exists, isn't global, and the user is its owner
+func (server *Server) validateDelete(msg *gochat.Msg) error {
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		return errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if msg.To == "global" {
+		// The global group is shared by all users and always exists
+		return errors.New("The group global can't be deleted!")
+	}
+	if group.Owner != msg.User {
+		return errors.New(fmt.Sprintf("You don't have permission to delete the group %s!", msg.To))
+	}
+	return nil
+}
+
+// Checks the group exists, isn't global, the user is its owner, and the new name
+// (given by msg.Msg) isn't taken
+func (server *Server) validateRename(msg *gochat.Msg) error {
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		return errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if msg.To == "global" {
+		// The global group is shared by all users and keeps its name
+		return errors.New("The group global can't be renamed!")
+	}
+	if group.Owner != msg.User {
+		return errors.New(fmt.Sprintf("You don't have permission to rename the group %s!", msg.To))
+	}
+	if msg.Msg == "" {
+		return errors.New("Please enter a new name for the group.")
+	}
+	if _, ok = server.Groups.Get(msg.Msg); ok {
+		return errors.New(fmt.Sprintf("Group %s already exists!", msg.Msg))
+	}
+	return nil
+}
+
+// Checks the group exists, the user is its owner, and the target user (given by msg.Msg) is
+// in the group but not yet a moderator
+func (server *Server) validateMod(msg *gochat.Msg) error {
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		return errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if group.Owner != msg.User {
+		return errors.New(fmt.Sprintf("You don't have permission to add moderators to group %s!", msg.To))
+	}
+	if !group.Users.Contains(msg.Msg) {
+		return errors.New(fmt.Sprintf("User %s isn't in the group %s.", msg.Msg, msg.To))
+	}
+	if group.Mods.Contains(msg.Msg) {
+		return errors.New(fmt.Sprintf("User %s is already a moderator of the group %s.", msg.Msg, msg.To))
+	}
+	return nil
+}
+
+// Checks the group exists, the user is its owner, and the interval (given by msg.Msg) is a
+// whole number of seconds. Returns the interval
+func (server *Server) validateSlowMode(msg *gochat.Msg) (interval time.Duration, err error) {
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if group.Owner != msg.User {
+		return 0, errors.New(fmt.Sprintf("You don't have permission to set slow mode on group %s!", msg.To))
+	}
+	seconds, err := strconv.Atoi(msg.Msg)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("Please enter how many seconds members must wait between messages.")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Checks the group exists, the user is its owner, and the limit (given by msg.Msg) is a whole
+// number of members. Returns the limit
+func (server *Server) validateLimit(msg *gochat.Msg) (limit int, err error) {
+	owner, ok := server.Groups.Owner(msg.To)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if owner != msg.User {
+		return 0, errors.New(fmt.Sprintf("You don't have permission to limit group %s!", msg.To))
+	}
+	if limit, err = strconv.Atoi(msg.Msg); err != nil || limit < 0 {
+		return 0, errors.New("Please enter how many members the group can have.")
+	}
+	return limit, nil
+}
+
+// Checks the group exists and the user is its owner
+func (server *Server) validateOwner(msg *gochat.Msg) error {
+	owner, ok := server.Groups.Owner(msg.To)
+	if !ok {
+		return errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if owner != msg.User {
+		return errors.New(fmt.Sprintf("You don't have permission to %s group %s!", msg.Cmd, msg.To))
+	}
+	return nil
+}
+
+// Checks the group exists, the user is in it, and they aren't already away from it for 'afk',
+// or are away from it for 'back'
+func (server *Server) validateAway(msg *gochat.Msg) error {
+	if err := server.requireMember(msg.User, msg.To); err != nil {
+		return err
+	}
+	away := server.Groups.IsAway(msg.To, msg.User)
+	if msg.Cmd == "afk" && away {
+		return errors.New(fmt.Sprintf("You're already away from the group %s.", msg.To))
+	}
+	if msg.Cmd == "back" && !away {
+		return errors.New(fmt.Sprintf("You aren't away from the group %s.", msg.To))
+	}
+	return nil
+}
+
+// Checks the group exists and the user is its owner or a moderator
+func (server *Server) validatePin(msg *gochat.Msg) error {
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		return errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if group.Owner != msg.User && !server.Groups.IsModerator(msg.To, msg.User) {
+		return errors.New(fmt.Sprintf("You don't have permission to %s messages in group %s!", msg.Cmd, msg.To))
+	}
+	if msg.Cmd == "pin" && msg.Msg == "" {
+		return errors.New("Please enter a message to pin.")
+	}
+	return nil
+}
+
+// Checks the group exists, the user is in it, and each target user (given by msg.Msg separated
+// by commas, allowing a unique prefix of their name) is online and not in the group yet. Returns
+// the users to invite
+func (server *Server) validateInvite(msg *gochat.Msg) (targets []string, err error) {
+	if err = server.validateGroup(msg); err != nil {
+		return nil, err
+	}
+	names := inviteNames(msg.Msg)
+	if len(names) == 0 {
+		return nil, errors.New("Please enter the user to invite.")
+	}
+	for _, name := range names {
+		target, err := server.validateInviteTarget(msg.To, name)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// Checks the target user (allowing a unique prefix of their name) is online and not in the
+// group yet. Returns the user to invite
+func (server *Server) validateInviteTarget(group, name string) (target string, err error) {
+	target, candidates := resolveUser(name, server.Addrs.Users())
+	if len(candidates) > 1 {
+		return "", errors.New(ambiguousUser(name, candidates))
+	}
+	if !server.Addrs.Online(target) {
+		return "", errors.New(fmt.Sprintf("User %s isn't online.", name))
+	}
+	if contains, _ := server.Groups.ContainsUser(group, target); contains {
+		return "", errors.New(fmt.Sprintf("User %s is already in the group %s.", target, group))
+	}
+	return target, nil
+}
+
+// Splits a comma separated list of users to invite, skipping any empty names
+func inviteNames(list string) (names []string) {
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// Checks the target user (msg.To, allowing a unique prefix of their name) is another user who
+// is online, and the group to create for the two of them (msg.Msg) doesn't exist yet. Returns
+// the target user
+func (server *Server) validatePromote(msg *gochat.Msg) (target string, err error) {
+	if msg.To == "" {
+		return "", errors.New("Please enter the user to create a group with.")
+	}
+	target, candidates := resolveUser(msg.To, server.Addrs.Users())
+	if len(candidates) > 1 {
+		return "", errors.New(ambiguousUser(msg.To, candidates))
+	}
+	if !server.Addrs.Online(target) {
+		return "", errors.New(fmt.Sprintf("User %s isn't online.", msg.To))
+	}
+	if target == msg.User {
+		return "", errors.New("You can't create a group with yourself this way, use create instead.")
+	}
+	if err = server.validateCreate(&gochat.Msg{User: msg.User, To: msg.Msg}); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// Checks the group exists, the user is its owner or a moderator, the target user (the first
+// argument of msg.Msg, allowing a unique prefix of their name) is in the group and isn't its
+// owner, and how long to mute them for (the second argument of msg.Msg) is a positive number
+// of seconds. Returns the user to mute and for how long
+func (server *Server) validateTempMute(msg *gochat.Msg) (target string, duration time.Duration, err error) {
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		return "", 0, errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if group.Owner != msg.User && !server.Groups.IsModerator(msg.To, msg.User) {
+		return "", 0, errors.New(fmt.Sprintf("You don't have permission to mute users in group %s!", msg.To))
+	}
+	args := gochat.SplitArgs(msg.Msg, 2)
+	if len(args) < 2 {
+		return "", 0, errors.New("Please enter a user to mute and how many seconds to mute them for.")
+	}
+	target, candidates := resolveUser(args[0], group.Users.Array())
+	if len(candidates) > 1 {
+		return "", 0, errors.New(ambiguousUser(args[0], candidates))
+	}
+	if !group.Users.Contains(target) {
+		return "", 0, errors.New(fmt.Sprintf("User %s isn't in the group %s.", args[0], msg.To))
+	}
+	if target == group.Owner {
+		return "", 0, errors.New(fmt.Sprintf("You don't have permission to mute the owner of group %s!", msg.To))
+	}
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil || seconds <= 0 {
+		return "", 0, errors.New("Please enter how many seconds to mute them for.")
+	}
+	return target, time.Duration(seconds) * time.Second, nil
+}
+
+// Checks the user is an admin
+func (server *Server) validateAdmin(msg *gochat.Msg) error {
+	if !server.Admins.Contains(msg.User) {
+		return errors.New(fmt.Sprintf("You don't have permission to use %s!", msg.Cmd))
+	}
+	return nil
+}
+
+// Checks who's being reported (given by msg.To) and why were given, allowing a unique prefix of
+// an online user's name. Offline users can still be reported. Returns the user being reported
+func (server *Server) validateReport(msg *gochat.Msg) (string, error) {
+	if msg.To == "" || msg.Msg == "" {
+		return "", errors.New("Please enter who you're reporting and why.")
+	}
+	target, candidates := resolveUser(msg.To, server.Addrs.Users())
+	if len(candidates) > 1 {
+		return "", errors.New(ambiguousUser(msg.To, candidates))
+	}
+	if target == msg.User {
+		return "", errors.New("You can't report yourself.")
+	}
+	return target, nil
+}
+
+// Checks the user is an admin and how many groups to list (given by msg.To) is a positive
+// number, defaulting to defaultTopGroups. Returns how many groups to list
+func (server *Server) validateTopGroups(msg *gochat.Msg) (n int, err error) {
+	if err = server.validateAdmin(msg); err != nil {
+		return 0, err
+	}
+	if msg.To == "" {
+		return defaultTopGroups, nil
+	}
+	if n, err = strconv.Atoi(msg.To); err != nil || n <= 0 {
+		return 0, errors.New("Please enter how many groups to list.")
+	}
+	return n, nil
+}
+
+// Checks the user is an admin and how many disconnects to list (given by msg.To) is a positive
+// number, defaulting to defaultRecent. Returns how many disconnects to list
+func (server *Server) validateRecent(msg *gochat.Msg) (n int, err error) {
+	if err = server.validateAdmin(msg); err != nil {
+		return 0, err
+	}
+	if msg.To == "" {
+		return defaultRecent, nil
+	}
+	if n, err = strconv.Atoi(msg.To); err != nil || n <= 0 {
+		return 0, errors.New("Please enter how many disconnects to list.")
+	}
+	return n, nil
+}
+
+// Checks the group exists, the user is its owner or a moderator, and the target user (given by
+// msg.Msg, allowing a unique prefix of their name) is in the group. Moderators can't remove
+// the owner. Returns the user to remove
+func (server *Server) validateKick(msg *gochat.Msg) (target string, err error) {
+	group, ok := server.Groups.Get(msg.To)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Group %s doesn't exist!", msg.To))
+	}
+	if group.Owner != msg.User && !server.Groups.IsModerator(msg.To, msg.User) {
+		return "", errors.New(fmt.Sprintf("You don't have permission to remove users from group %s!", msg.To))
+	}
+	target, candidates := resolveUser(msg.Msg, group.Users.Array())
+	if len(candidates) > 1 {
+		return "", errors.New(ambiguousUser(msg.Msg, candidates))
+	}
+	if target == group.Owner && target != msg.User {
+		return "", errors.New(fmt.Sprintf("You don't have permission to remove the owner of group %s!", msg.To))
+	}
+	if !group.Users.Contains(target) {
+		return "", errors.New(fmt.Sprintf("User %s isn't in the group %s.", msg.Msg, msg.To))
+	}
+	return target, nil
+}
@@ -0,0 +1,185 @@
+package gochat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Carries messages between clients and a server, so alternative transports (such as UDP,
+// WebSockets, or in-memory) can be plugged in. TCPTransport is the default
+type Transport interface {
+	// Sends the message to the given address
+	Send(addr string, msg *Msg) error
+	// Starts receiving the messages sent to the given address
+	Listen(addr string) (MsgListener, error)
+}
+
+// Receives the messages sent to the address a Transport is listening on
+type MsgListener interface {
+	// Returns the channel received messages are delivered on, which is closed after the
+	// MsgListener is
+	Msgs() <-chan *Msg
+	// Returns the address being listened on. This includes the port actually bound if any
+	// port was asked for, such as with "localhost:0"
+	Addr() string
+	// Stops receiving messages
+	Close() error
+}
+
+// Transport that sends each message as a gob over its own connection from Dialer, and
+// listens for them over TCP. Dialer can be swapped, such as for a PipeDialer in tests
+type TCPTransport struct {
+	Dialer Dialer // nil uses DefaultDialer
+}
+
+// MsgListener of a TCPTransport
+type tcpListener struct {
+	listener net.Listener
+	msgs chan *Msg
+	done chan struct{} // closed once Close is called
+	closeOnce sync.Once
+}
+
+// Returns the Dialer messages are sent over
+func (transport *TCPTransport) dialer() Dialer {
+	if transport.Dialer == nil {
+		return DefaultDialer
+	}
+	return transport.Dialer
+}
+
+// Dials a connection with the TCPTransport's Dialer, so it can also be used as a Dialer
+func (transport *TCPTransport) Dial(network, addr string) (net.Conn, error) {
+	return transport.dialer().Dial(network, addr)
+}
+
+// Sends the message to the given address
+func (transport *TCPTransport) Send(addr string, msg *Msg) error {
+	return msg.SendWith(transport.dialer(), addr)
+}
+
+// Listens on the given TCP address, decoding a message from each connection accepted
+func (transport *TCPTransport) Listen(addr string) (MsgListener, error) {
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener := &tcpListener{listener: listen, msgs: make(chan *Msg), done: make(chan struct{})}
+	go listener.accept()
+	return listener, nil
+}
+
+func (listener *tcpListener) Msgs() <-chan *Msg {
+	return listener.msgs
+}
+
+func (listener *tcpListener) Addr() string {
+	return listener.listener.Addr().String()
+}
+
+func (listener *tcpListener) Close() (err error) {
+	listener.closeOnce.Do(func() {
+		close(listener.done)
+		err = listener.listener.Close()
+	})
+	return
+}
+
+// Bounds of how long a tcpListener waits after a failed accept before trying again
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Accepts connections until the listener is closed, delivering the message from each
+func (listener *tcpListener) accept() {
+	var handlers sync.WaitGroup
+	// How long to wait after a failed accept, which grows while they keep failing so a
+	// listener stuck in an error state (e.g. too many open files) doesn't spin
+	var acceptDelay time.Duration
+	for {
+		// Blocks until a message is received
+		conn, err := listener.listener.Accept()
+		if err != nil {
+			select {
+			case <-listener.done:
+				// Wait on any messages still being delivered before closing the channel
+				handlers.Wait()
+				close(listener.msgs)
+				return
+			default:
+			}
+			if acceptDelay == 0 {
+				acceptDelay = minAcceptDelay
+			} else if acceptDelay *= 2; acceptDelay > maxAcceptDelay {
+				acceptDelay = maxAcceptDelay
+			}
+			fmt.Printf("Error on accept: %s; retrying in %v\n", err, acceptDelay)
+			// Stop waiting as soon as the listener is closed
+			select {
+			case <-time.After(acceptDelay):
+			case <-listener.done:
+			}
+			continue
+		}
+		acceptDelay = 0
+		if err = KeepAlive(conn, KeepAlivePeriod); err != nil {
+			fmt.Println("Error setting keepalive:", err)
+		}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer conn.Close()
+			msg := &Msg{}
+			// Don't deliver a message that wasn't fully decoded
+			if err := msg.Retrieve(conn); err != nil {
+				fmt.Println("Error retrieving msg:", err)
+				return
+			}
+			select {
+			case listener.msgs <- msg:
+			case <-listener.done:
+				// Nothing is receiving anymore, so drop the message rather than block
+			}
+		}()
+	}
+}
+
+// Connection whose reads and writes go through buffers, to cut down on syscalls when many
+// small reads or writes are made, such as while decoding a gob. Writes aren't sent until Flush
+// or Close is called
+type BufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// Constructor function for BufferedConn, wrapping the connection in buffers of the given size
+func NewBufferedConn(conn net.Conn, size int) *BufferedConn {
+	return &BufferedConn{conn, bufio.NewReaderSize(conn, size), bufio.NewWriterSize(conn, size)}
+}
+
+func (buffered *BufferedConn) Read(p []byte) (int, error) {
+	return buffered.reader.Read(p)
+}
+
+func (buffered *BufferedConn) Write(p []byte) (int, error) {
+	return buffered.writer.Write(p)
+}
+
+// Sends anything written that's still buffered
+func (buffered *BufferedConn) Flush() error {
+	return buffered.writer.Flush()
+}
+
+// Flushes anything still buffered, then closes the connection
+func (buffered *BufferedConn) Close() error {
+	flushErr := buffered.writer.Flush()
+	if err := buffered.Conn.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}